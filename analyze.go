@@ -19,8 +19,7 @@ import (
 	"time"
 )
 
-func analyze(bkt objstore.Bucket, id, dir *string, analyzeLimit *int, analyzeMatchers *string, logger log.Logger) error {
-	ctx := context.Background()
+func analyze(ctx context.Context, bkt objstore.Bucket, id, dir *string, analyzeLimit *int, analyzeMatchers *string, logger log.Logger) error {
 	if err := downloadBlock(ctx, *dir, *id, bkt, logger); err != nil {
 		return err
 	}
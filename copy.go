@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/efficientgo/tools/extkingpin"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/client"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/model"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"io"
+	"strings"
+	"time"
+)
+
+func copyBlocks(ctx context.Context, bkt objstore.Bucket, ids *[]string, recursive *bool, selector *[]string, maxTime, dataMinTime, dataMaxTime *model.TimeOrDurationValue, dstConfig *extkingpin.PathOrContent, prefixMap *[]string, dryRun bool, logger log.Logger) error {
+	sel, err := parseSelector(*selector)
+	if err != nil {
+		return errors.Wrap(err, "error parsing selector flag")
+	}
+	prefixes, err := parsePrefixMap(*prefixMap)
+	if err != nil {
+		return err
+	}
+	objStoreYaml, err := dstConfig.Content()
+	if err != nil {
+		return err
+	}
+	dst, err := client.NewBucket(logger, objStoreYaml, "thanos-kit")
+	if err != nil {
+		return err
+	}
+
+	metas, err := getAllMetas(ctx, bkt, *recursive, maxTime, logger)
+	if err != nil {
+		return err
+	}
+	mint, maxt, _ := dataRange(dataMinTime, dataMaxTime)
+	selected := filterIDs(selectMetas(metas, sel, mint, maxt), *ids)
+	if missing := missingIDs(selected, *ids); len(missing) > 0 {
+		return errors.Errorf("requested blocks are not found or filtered out: %s", strings.Join(missing, ", "))
+	}
+
+	copied := 0
+	for _, m := range selected {
+		dstPrefix := m.Prefix
+		if p, ok := prefixes[m.Prefix]; ok {
+			dstPrefix = p
+		}
+		dstDir := dstPrefix + m.ULID.String()
+		ok, err := dst.Exists(ctx, dstDir+"/"+metadata.MetaFilename)
+		if err != nil {
+			return errors.Wrapf(err, "check %s exists in destination", dstDir)
+		}
+		if ok {
+			level.Info(logger).Log("msg", "block already exists in destination, skipping", "id", dstDir)
+			continue
+		}
+		if dryRun {
+			level.Info(logger).Log("msg", "dry-run: skipping copy of block", "from", m.Prefix+m.ULID.String(), "to", dstDir)
+			continue
+		}
+
+		begin := time.Now()
+		if err := copyBlock(ctx, bkt, dst, m, dstPrefix, logger); err != nil {
+			// cleanup even when interrupted
+			ctxd, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Minute)
+			defer cancel()
+			if cleanErr := block.Delete(ctxd, logger, objstore.NewPrefixedBucket(dst, dstPrefix), m.ULID); cleanErr != nil {
+				level.Error(logger).Log("msg", "failed to cleanup partially copied block", "id", dstDir, "err", cleanErr)
+			}
+			return errors.Wrapf(err, "copy block %s%s", m.Prefix, m.ULID)
+		}
+		copied++
+		level.Info(logger).Log("msg", "copied block", "from", m.Prefix+m.ULID.String(), "to", dstDir, "duration", time.Since(begin))
+	}
+	level.Info(logger).Log("msg", "done", "blocks", len(selected), "copied", copied)
+	return nil
+}
+
+// parsePrefixMap parses 'src=dst' pairs of block dirs prefixes
+func parsePrefixMap(s []string) (map[string]string, error) {
+	res := map[string]string{}
+	normalize := func(p string) string {
+		p = strings.Trim(p, "/")
+		if p != "" {
+			p += "/"
+		}
+		return p
+	}
+	for _, v := range s {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("unrecognized prefix mapping %q, should be 'src=dst'", v)
+		}
+		src := normalize(parts[0])
+		if _, ok := res[src]; ok {
+			return nil, errors.Errorf("duplicate prefix mapping for %q", parts[0])
+		}
+		res[src] = normalize(parts[1])
+	}
+	return res, nil
+}
+
+// copyBlock streams all block objects from src to dst bucket, meta.json is copied last
+// to not produce valid-looking partial blocks in the destination
+func copyBlock(ctx context.Context, src, dst objstore.Bucket, m *Meta, dstPrefix string, logger log.Logger) error {
+	srcDir := m.Prefix + m.ULID.String() + "/"
+	dstDir := dstPrefix + m.ULID.String() + "/"
+	files := map[string]metadata.File{}
+	for _, f := range m.Thanos.Files {
+		files[f.RelPath] = f
+	}
+
+	var names []string
+	err := src.Iter(ctx, srcDir, func(name string) error {
+		if strings.TrimPrefix(name, srcDir) != metadata.MetaFilename {
+			names = append(names, name)
+		}
+		return nil
+	}, objstore.WithRecursiveIter)
+	if err != nil {
+		return errors.Wrap(err, "list block objects")
+	}
+	names = append(names, srcDir+metadata.MetaFilename)
+
+	for _, name := range names {
+		rel := strings.TrimPrefix(name, srcDir)
+		if err := copyObject(ctx, src, dst, name, dstDir+rel, files[rel], logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyObject streams object from src to dst and verifies its size and hash (when known from meta.json)
+func copyObject(ctx context.Context, src, dst objstore.Bucket, from, to string, f metadata.File, logger log.Logger) error {
+	attrs, err := src.Attributes(ctx, from)
+	if err != nil {
+		return errors.Wrapf(err, "get attributes of %s", from)
+	}
+	r, err := src.Get(ctx, from)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", from)
+	}
+	defer runutil.CloseWithLogOnErr(logger, r, "close %s", from)
+
+	h := sha256.New()
+	if err := dst.Upload(ctx, to, sizedReader{Reader: io.TeeReader(r, h), size: attrs.Size}); err != nil {
+		return errors.Wrapf(err, "upload %s", to)
+	}
+
+	dstAttrs, err := dst.Attributes(ctx, to)
+	if err != nil {
+		return errors.Wrapf(err, "get attributes of %s", to)
+	}
+	if dstAttrs.Size != attrs.Size {
+		return errors.Errorf("size mismatch for %s: source %d, destination %d", to, attrs.Size, dstAttrs.Size)
+	}
+	if f.SizeBytes != 0 && f.SizeBytes != attrs.Size {
+		return errors.Errorf("size mismatch for %s: meta.json %d, source %d", from, f.SizeBytes, attrs.Size)
+	}
+	if f.Hash != nil && f.Hash.Func == metadata.SHA256Func {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != f.Hash.Value {
+			return errors.Errorf("hash mismatch for %s: meta.json %s, copied %s", from, f.Hash.Value, sum)
+		}
+	}
+	level.Debug(logger).Log("msg", "copied object", "from", from, "to", to, "size", fmt.Sprint(attrs.Size))
+	return nil
+}
+
+// sizedReader is a stream of known size, so destination bucket could upload it without buffering
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+func (r sizedReader) ObjectSize() (int64, error) {
+	return r.size, nil
+}
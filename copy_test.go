@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/tools/extkingpin"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/model"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// uploadRecordingBucket records uploaded objects, and fails uploads of unknown size
+type uploadRecordingBucket struct {
+	objstore.Bucket
+	uploads []string
+}
+
+func (b *uploadRecordingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if _, err := objstore.TryToGetSize(r); err != nil {
+		return err
+	}
+	b.uploads = append(b.uploads, name)
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func Test_parsePrefixMap(t *testing.T) {
+	cases := []struct {
+		s         []string
+		res       map[string]string
+		expectErr bool
+	}{
+		{s: []string{"tenant1="}, res: map[string]string{"tenant1/": ""}},
+		{s: []string{"=tenant1", "/a/b/=c/"}, res: map[string]string{"": "tenant1/", "a/b/": "c/"}},
+		{s: []string{"tenant1=a", "tenant1/=b"}, expectErr: true},
+		{s: []string{"=a", "/=b"}, expectErr: true},
+		{s: []string{"tenant1"}, expectErr: true},
+	}
+	for _, td := range cases {
+		res, err := parsePrefixMap(td.s)
+		if td.expectErr {
+			if err == nil {
+				t.Errorf("parsePrefixMap(%q) should fail", td.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePrefixMap(%q): %v", td.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, td.res) {
+			t.Errorf("parsePrefixMap(%q)=%q, wants %q", td.s, res, td.res)
+		}
+	}
+}
+
+func Test_copyObject(t *testing.T) {
+	ctx := context.Background()
+	src := objstore.NewInMemBucket()
+	data := "chunks data"
+	if err := src.Upload(ctx, "a/chunks/000001", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(data))
+
+	cases := []struct {
+		f         metadata.File
+		expectErr bool
+	}{
+		{f: metadata.File{}},
+		{f: metadata.File{SizeBytes: int64(len(data)), Hash: &metadata.ObjectHash{Func: metadata.SHA256Func, Value: hex.EncodeToString(sum[:])}}},
+		{f: metadata.File{SizeBytes: int64(len(data)), Hash: &metadata.ObjectHash{Func: metadata.SHA256Func, Value: "broken"}}, expectErr: true},
+		{f: metadata.File{SizeBytes: 1}, expectErr: true},
+	}
+	for _, td := range cases {
+		dst := &uploadRecordingBucket{Bucket: objstore.NewInMemBucket()}
+		err := copyObject(ctx, src, dst, "a/chunks/000001", "b/chunks/000001", td.f, log.NewNopLogger())
+		if td.expectErr != (err != nil) {
+			t.Errorf("copyObject(%+v)=%v, wants error %v", td.f, err, td.expectErr)
+		}
+	}
+}
+
+func Test_copyBlock(t *testing.T) {
+	ctx := context.Background()
+	src := objstore.NewInMemBucket()
+	id := ulid.MustNew(1, nil)
+	meta := uploadTestMeta(t, src, "tenant/", id, nil)
+	for _, name := range []string{"index", "chunks/000001", "chunks/000002"} {
+		if err := src.Upload(ctx, "tenant/"+id.String()+"/"+name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := &uploadRecordingBucket{Bucket: objstore.NewInMemBucket()}
+	if err := copyBlock(ctx, src, dst, &Meta{Meta: *meta, Prefix: "tenant/"}, "", log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if len(dst.uploads) != 4 {
+		t.Fatalf("copyBlock() uploaded %q, wants 4 objects", dst.uploads)
+	}
+	if last := dst.uploads[len(dst.uploads)-1]; last != path.Join(id.String(), metadata.MetaFilename) {
+		t.Errorf("copyBlock() uploaded %s last, wants meta.json", last)
+	}
+}
+
+func Test_copyMissingIDs(t *testing.T) {
+	bkt := objstore.NewInMemBucket()
+	id1, missing := ulid.MustNew(1, nil), ulid.MustNew(3, nil)
+	uploadTestMeta(t, bkt, "", id1, map[string]string{"p": "a"})
+	dstDir := t.TempDir()
+	app := kingpin.New("test", "")
+	dstConfig := extkingpin.RegisterPathOrContent(app, "dst.config", "")
+	if _, err := app.Parse([]string{"--dst.config=type: FILESYSTEM\nconfig:\n  directory: " + dstDir}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, recursive, selector, prefixMap := []string{id1.String(), missing.String()}, false, []string{}, []string{}
+	err := copyBlocks(context.Background(), bkt, &ids, &recursive, &selector, testTime(t, "9999-12-31T23:59:59Z"), &model.TimeOrDurationValue{}, &model.TimeOrDurationValue{}, dstConfig, &prefixMap, false, log.NewNopLogger())
+	if err == nil || !strings.Contains(err.Error(), missing.String()) || strings.Contains(err.Error(), id1.String()) {
+		t.Fatalf("copyBlocks(%q)=%v, wants %s to be reported", ids, err, missing)
+	}
+	if entries, err := os.ReadDir(dstDir); err != nil || len(entries) > 0 {
+		t.Errorf("copyBlocks(%q) copied %v, wants nothing to be copied", ids, entries)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
@@ -16,11 +17,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func dump(bkt objstore.Bucket, out io.Writer, ids *[]string, dir *string, mint, maxt *int64, match *string, logger log.Logger) error {
-	ctx := context.Background()
+func dump(ctx context.Context, bkt objstore.Bucket, out io.Writer, ids *[]string, dir *string, mint, maxt *int64, match *string, logger log.Logger) error {
 	for _, id := range *ids {
 		if _, err := ulid.Parse(id); err != nil {
 			return errors.Wrapf(err, `invalid ULID "%s"`, id)
@@ -60,20 +62,21 @@ func dumpSamples(out io.Writer, path string, mint, maxt int64, match string) (er
 		lbs := series.Labels().MatchLabels(false, "__name__")
 		// todo: add thanos labels?
 		it := series.Iterator(nil)
-		for it.Next() == chunkenc.ValFloat {
-			ts, val := it.At()
-			fmt.Fprintf(out, "%s%s %g %d\n", name, lbs, val, ts)
-		}
-		for it.Next() == chunkenc.ValFloatHistogram {
-			ts, fh := it.AtFloatHistogram()
-			fmt.Fprintf(out, "%s%s %s %d\n", name, lbs, fh.String(), ts)
-		}
-		for it.Next() == chunkenc.ValHistogram {
-			ts, h := it.AtHistogram()
-			fmt.Fprintf(out, "%s%s %s %d\n", name, lbs, h.String(), ts)
+		for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+			switch vt {
+			case chunkenc.ValFloat:
+				ts, val := it.At()
+				fmt.Fprintf(out, "%s%s %g %d\n", name, lbs, val, ts)
+			case chunkenc.ValHistogram:
+				ts, h := it.AtHistogram()
+				fmt.Fprintf(out, "%s%s %s %d\n", name, lbs, formatHistogram(h, nil), ts)
+			case chunkenc.ValFloatHistogram:
+				ts, fh := it.AtFloatHistogram()
+				fmt.Fprintf(out, "%s%s %s %d\n", name, lbs, formatHistogram(nil, fh), ts)
+			}
 		}
 		if it.Err() != nil {
-			return ss.Err()
+			return it.Err()
 		}
 	}
 
@@ -87,6 +90,63 @@ func dumpSamples(out io.Writer, path string, mint, maxt int64, match string) (er
 	return nil
 }
 
+// formatHistogram returns native histogram as a single token without spaces, which is parsed back by parseHistogram:
+// {type:int,schema:0,count:5,sum:10.5,zero_threshold:0.001,zero_count:1,positive_spans:[-1:2,1:2],positive_buckets:[1,2,0,2],negative_spans:[],negative_buckets:[]}
+// Buckets are absolute counts. Counter reset hint is only kept for gauge histograms, as others depend on chunk layout.
+func formatHistogram(h *histogram.Histogram, fh *histogram.FloatHistogram) string {
+	var b strings.Builder
+	if h != nil {
+		fmt.Fprintf(&b, "{type:int,schema:%d,count:%d,sum:%s,zero_threshold:%s,zero_count:%d",
+			h.Schema, h.Count, formatFloat(h.Sum), formatFloat(h.ZeroThreshold), h.ZeroCount)
+		writeBuckets(&b, "positive", h.PositiveSpans, absoluteBuckets(h.PositiveBuckets))
+		writeBuckets(&b, "negative", h.NegativeSpans, absoluteBuckets(h.NegativeBuckets))
+	} else {
+		fmt.Fprintf(&b, "{type:float,schema:%d,count:%s,sum:%s,zero_threshold:%s,zero_count:%s",
+			fh.Schema, formatFloat(fh.Count), formatFloat(fh.Sum), formatFloat(fh.ZeroThreshold), formatFloat(fh.ZeroCount))
+		writeBuckets(&b, "positive", fh.PositiveSpans, floatBuckets(fh.PositiveBuckets))
+		writeBuckets(&b, "negative", fh.NegativeSpans, floatBuckets(fh.NegativeBuckets))
+	}
+	if (h != nil && h.CounterResetHint == histogram.GaugeType) || (fh != nil && fh.CounterResetHint == histogram.GaugeType) {
+		b.WriteString(",counter_reset_hint:gauge")
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func writeBuckets(b *strings.Builder, name string, spans []histogram.Span, buckets []string) {
+	fmt.Fprintf(b, ",%s_spans:[", name)
+	for i, s := range spans {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(b, "%d:%d", s.Offset, s.Length)
+	}
+	fmt.Fprintf(b, "],%s_buckets:[%s]", name, strings.Join(buckets, ","))
+}
+
+// absoluteBuckets converts delta encoded integer buckets to absolute counts
+func absoluteBuckets(deltas []int64) []string {
+	res := make([]string, len(deltas))
+	var v int64
+	for i, d := range deltas {
+		v += d
+		res[i] = strconv.FormatInt(v, 10)
+	}
+	return res
+}
+
+func floatBuckets(buckets []float64) []string {
+	res := make([]string, len(buckets))
+	for i, v := range buckets {
+		res[i] = formatFloat(v)
+	}
+	return res
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
 // download block id to dir
 func downloadBlock(ctx context.Context, dir, id string, bkt objstore.Bucket, logger log.Logger) error {
 	dest := filepath.Join(dir, id)
@@ -1,36 +1,69 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/heap"
 	"context"
+	"encoding/binary"
+	"encoding/csv"
 	"fmt"
 	"github.com/alecthomas/units"
+	"github.com/efficientgo/tools/extkingpin"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
-	"github.com/prometheus/prometheus/tsdb/fileutil"
 	"github.com/thanos-io/objstore"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v2"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 )
 
-func importMetrics(bkt objstore.Bucket, file *string, importBlockSize *time.Duration, dir *string, importLabels *[]string, upload bool, logger log.Logger) error {
-	inputFile, err := fileutil.OpenMmapFile(*file)
+const (
+	inputChunkSize = 32 << 20
+	// mergeChunkSize is used instead of inputChunkSize for each of the files merged by timestamp
+	mergeChunkSize = 1 << 20
+	// mergeFanIn limits number of input files or sorted runs merged at once, more are merged in multiple passes
+	mergeFanIn = 64
+	// relabelCacheSize limits number of series with cached relabeling results, each ~1KB
+	relabelCacheSize = 100000
+)
+
+var omEOF = []byte("# EOF\n")
+
+func importMetrics(ctx context.Context, bkt objstore.Bucket, inputs *[]string, format inputFormat, importRelabel extkingpin.PathOrContent, importBlockSize *time.Duration, dir *string, importLabels *[]string, upload bool, maxOpen int, sortInput bool, sortBuffer int, logger log.Logger) error {
+	files, err := expandInputs(*inputs)
 	if err != nil {
 		return err
 	}
-	defer inputFile.Close()
 
 	if err := os.MkdirAll(*dir, 0o777); err != nil {
 		return fmt.Errorf("create output dir: %w", err)
@@ -40,13 +73,29 @@ func importMetrics(bkt objstore.Bucket, file *string, importBlockSize *time.Dura
 	if err != nil {
 		return errors.Wrap(err, "parse thanos labels")
 	}
-
-	p := textparse.NewPromParser(inputFile.Bytes())
-	maxt, mint, err := getMinAndMaxTimestamps(p)
+	relabelContentYaml, err := importRelabel.Content()
 	if err != nil {
-		return fmt.Errorf("getting min and max timestamp: %w", err)
+		return fmt.Errorf("get content of relabel configuration: %w", err)
+	}
+	var relabelConfig []*relabel.Config
+	if err := yaml.Unmarshal(relabelContentYaml, &relabelConfig); err != nil {
+		return fmt.Errorf("parse relabel configuration: %w", err)
+	}
+	if format.name == "csv" {
+		if err := format.csv.validate(); err != nil {
+			return err
+		}
+	}
+	if maxOpen < 1 {
+		return errors.New("--max-open-blocks should be at least 1")
 	}
-	ids, err := createBlocks(inputFile.Bytes(), mint, maxt, int64(*importBlockSize/time.Millisecond), 5000, *dir, true, labels, logger)
+	if !sortInput {
+		sortBuffer = 0
+	} else if sortBuffer <= 0 {
+		return errors.New("--sort-buffer should be positive")
+	}
+
+	ids, err := createBlocks(ctx, files, format, relabelConfig, int64(*importBlockSize/time.Millisecond), 5000, maxOpen, sortBuffer, *dir, true, labels, logger)
 	if err != nil {
 		return fmt.Errorf("block creation: %w", err)
 	}
@@ -54,8 +103,14 @@ func importMetrics(bkt objstore.Bucket, file *string, importBlockSize *time.Dura
 	if upload {
 		for _, id := range ids {
 			begin := time.Now()
-			err = block.Upload(context.Background(), logger, bkt, filepath.Join(*dir, id.String()), metadata.SHA256Func)
+			err = block.Upload(ctx, logger, bkt, filepath.Join(*dir, id.String()), metadata.SHA256Func)
 			if err != nil {
+				// do not leave partially uploaded block, even when interrupted
+				ctxd, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Minute)
+				defer cancel()
+				if err := block.Delete(ctxd, logger, bkt, id); err != nil {
+					level.Error(logger).Log("msg", "failed to cleanup partially uploaded block", "id", id.String(), "err", err)
+				}
 				return errors.Wrapf(err, "upload block %s", id.String())
 			}
 			level.Info(logger).Log("msg", "uploaded block", "id", id.String(), "duration", time.Since(begin))
@@ -64,194 +119,1502 @@ func importMetrics(bkt objstore.Bucket, file *string, importBlockSize *time.Dura
 	return nil
 }
 
-func getMinAndMaxTimestamps(p textparse.Parser) (int64, int64, error) {
-	var maxt, mint int64 = math.MinInt64, math.MaxInt64
-
-	for {
-		entry, err := p.Next()
-		if errors.Is(err, io.EOF) {
-			break
+func getCompatibleBlockDuration(maxBlockDuration int64) int64 {
+	blockDuration := tsdb.DefaultBlockDuration
+	if maxBlockDuration > tsdb.DefaultBlockDuration {
+		ranges := tsdb.ExponentialBlockRanges(tsdb.DefaultBlockDuration, 10, 3)
+		idx := len(ranges) - 1 // Use largest range if user asked for something enormous.
+		for i, v := range ranges {
+			if v > maxBlockDuration {
+				idx = i - 1
+				break
+			}
 		}
+		blockDuration = ranges[idx]
+	}
+	return blockDuration
+}
+
+// createBlocks parses input once, and routes samples to blocks by time range and extracted labels
+// https://github.com/prometheus/prometheus/blob/main/cmd/promtool/backfill.go#L87
+func createBlocks(ctx context.Context, files []string, format inputFormat, relabelConfig []*relabel.Config, maxBlockDuration int64, maxSamplesInAppender, maxOpen, sortBuffer int, outputDir string, humanReadable bool, lbls labels.Labels, logger log.Logger) (ids []ulid.ULID, returnErr error) {
+	bw := newTenantWriters(relabelConfig, func() *blockWriters {
+		return newBlockWriters(outputDir, getCompatibleBlockDuration(maxBlockDuration), maxSamplesInAppender, maxOpen, logger)
+	})
+	defer func() {
+		returnErr = tsdb_errors.NewMulti(returnErr, bw.close()).Err()
+	}()
+
+	var stats skippedEntries
+	var err error
+	switch {
+	case sortBuffer > 0:
+		err = sortInputs(ctx, files, format, sortBuffer, filepath.Join(outputDir, "sort"), bw, &stats, logger)
+	case len(files) == 1:
+		err = parseInput(ctx, files[0], format, inputChunkSize, bw, &stats)
+	default:
+		err = mergeInputs(ctx, files, format, mergeFanIn, filepath.Join(outputDir, "merge"), bw, &stats, logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// TSDB blocks have no place to store these
+	if stats.metadata > 0 {
+		level.Warn(logger).Log("msg", "metadata (HELP, TYPE, UNIT) is not stored in TSDB blocks, skipped", "entries", stats.metadata)
+	}
+	if stats.exemplars > 0 {
+		level.Warn(logger).Log("msg", "exemplars are not stored in TSDB blocks, skipped", "exemplars", stats.exemplars)
+	}
+	if bw.dropped > 0 {
+		level.Info(logger).Log("msg", "samples dropped by relabeling", "samples", bw.dropped)
+	}
+
+	blockLabels := map[ulid.ULID]map[string]string{}
+	for _, t := range bw.tenants {
+		tids, err := t.writers.flush(ctx)
 		if err != nil {
-			return 0, 0, fmt.Errorf("next: %w", err)
+			return nil, err
+		}
+		l := lbls.Map()
+		for _, e := range t.extLabels {
+			l[e.Name] = e.Value
+		}
+		for _, id := range tids {
+			blockLabels[id] = l
+		}
+		ids = append(ids, tids...)
+	}
+
+	db, err := tsdb.OpenDBReadOnly(outputDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		returnErr = tsdb_errors.NewMulti(returnErr, db.Close()).Err()
+	}()
+	blocks, err := db.Blocks()
+	if err != nil {
+		return nil, fmt.Errorf("get blocks: %w", err)
+	}
+	wroteHeader := false
+	for _, id := range ids {
+		for _, b := range blocks {
+			if b.Meta().ULID == id {
+				if err = writeThanosMeta(b.Meta(), blockLabels[id], 0, outputDir, logger); err != nil {
+					return nil, fmt.Errorf("write metadata: %w", err)
+				}
+				printBlocks([]tsdb.BlockReader{b}, !wroteHeader, humanReadable)
+				wroteHeader = true
+				break
+			}
 		}
+	}
+	return ids, nil
+}
+
+// inputFormat describes how to parse input files
+type inputFormat struct {
+	name string // prom, openmetrics, remote-write or csv
+	csv  csvConfig
+}
 
-		if entry != textparse.EntrySeries {
+// skippedEntries counts input entries which are not stored in blocks
+type skippedEntries struct {
+	metadata  int
+	exemplars int
+}
+
+// sampleAppender receives parsed samples
+type sampleAppender interface {
+	append(ctx context.Context, s sample) error
+}
+
+// sample is a float sample, or a native histogram one when h or fh is set
+type sample struct {
+	l  labels.Labels
+	t  int64
+	v  float64
+	h  *histogram.Histogram
+	fh *histogram.FloatHistogram
+}
+
+// expandInputs returns list of files for given file names, globs or directories
+func expandInputs(inputs []string) (files []string, err error) {
+	for _, in := range inputs {
+		if in == "-" {
+			files = append(files, in)
 			continue
 		}
+		matches, err := filepath.Glob(in)
+		if err != nil {
+			return nil, fmt.Errorf("input %s: %w", in, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("input %s: no such file", in)
+		}
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil {
+				return nil, err
+			}
+			if !fi.IsDir() {
+				files = append(files, m)
+				continue
+			}
+			entries, err := os.ReadDir(m)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.Type().IsRegular() {
+					files = append(files, filepath.Join(m, e.Name()))
+				}
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no input files found")
+	}
+	return files, nil
+}
 
-		_, ts, _ := p.Series()
-		if ts == nil {
-			return 0, 0, fmt.Errorf("expected timestamp for series got none")
+// parseInput appends all the samples from file to app. Text formats are read by chunks of about chunkSize bytes
+func parseInput(ctx context.Context, file string, format inputFormat, chunkSize int, app sampleAppender, stats *skippedEntries) error {
+	input, err := openInput(file)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	switch format.name {
+	case "remote-write":
+		return parseRemoteWrite(ctx, input, app, stats)
+	case "csv":
+		return parseCSV(ctx, input, format.csv, app)
+	}
+
+	done := false
+	return readChunks(input, chunkSize, func(chunk []byte, last bool) error {
+		if format.name != "openmetrics" {
+			return parsePromText(ctx, chunk, app, stats)
+		}
+		// OpenMetrics parser expects each chunk to be terminated by # EOF
+		switch {
+		case done && len(bytes.TrimSpace(chunk)) > 0:
+			return errors.New("parse: unexpected data after # EOF")
+		case done:
+			return nil
+		case bytes.HasSuffix(chunk, omEOF):
+			done = true
+		case !last:
+			chunk = append(chunk, omEOF...)
 		}
+		return parseText(ctx, textparse.NewOpenMetricsParser(chunk), format.name, app, stats)
+	})
+}
 
-		if *ts > maxt {
-			maxt = *ts
+// mergeInputs parses files concurrently, and appends samples to app ordered by timestamp.
+// So that time-sorted files produce the same blocks as a single file with all the samples.
+// When there are more than fanIn files, they are merged by groups to temporary runs in dir first.
+func mergeInputs(ctx context.Context, files []string, format inputFormat, fanIn int, dir string, app sampleAppender, stats *skippedEntries, logger log.Logger) (err error) {
+	fileStats := make([]skippedEntries, len(files))
+	producers := make([]func(context.Context, sampleAppender) error, len(files))
+	for i, file := range files {
+		i, file := i, file
+		producers[i] = func(ctx context.Context, app sampleAppender) error {
+			if err := parseInput(ctx, file, format, mergeChunkSize, app, &fileStats[i]); err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			return nil
 		}
-		if *ts < mint {
-			mint = *ts
+	}
+	defer func() {
+		for _, s := range fileStats {
+			stats.metadata += s.metadata
+			stats.exemplars += s.exemplars
 		}
+	}()
+	if len(producers) <= fanIn {
+		return mergeSorted(ctx, producers, app)
 	}
 
-	if maxt == math.MinInt64 {
-		maxt = 0
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return fmt.Errorf("create merge dir: %w", err)
+	}
+	defer func() {
+		err = tsdb_errors.NewMulti(err, os.RemoveAll(dir)).Err()
+	}()
+	level.Info(logger).Log("msg", "merging input files by groups", "files", len(files), "group", fanIn)
+	var runs []string
+	for i := 0; i < len(producers); i += fanIn {
+		group := producers[i:min(i+fanIn, len(producers))]
+		name := filepath.Join(dir, fmt.Sprintf("run-%06d", len(runs)))
+		if err := writeRun(name, func(w sampleAppender) error { return mergeSorted(ctx, group, w) }); err != nil {
+			return err
+		}
+		runs = append(runs, name)
 	}
-	if mint == math.MaxInt64 {
-		mint = 0
+	return mergeRuns(ctx, dir, runs, fanIn, app, logger)
+}
+
+// mergeSorted runs producers concurrently, and appends their samples to app ordered by timestamp
+func mergeSorted(ctx context.Context, producers []func(context.Context, sampleAppender) error, app sampleAppender) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	streams := make([]*sampleStream, len(producers))
+	for i, produce := range producers {
+		ch := make(chan []sample, 4)
+		streams[i] = &sampleStream{ch: ch}
+		produce := produce
+		eg.Go(func() error {
+			defer close(ch)
+			b := &batchAppender{ch: ch}
+			if err := produce(ctx, b); err != nil {
+				return err
+			}
+			return b.flush(ctx)
+		})
 	}
 
-	return maxt, mint, nil
+	eg.Go(func() error {
+		h := sampleHeap{}
+		for _, s := range streams {
+			if s.next() {
+				h = append(h, s)
+			}
+		}
+		heap.Init(&h)
+		for i := 0; h.Len() > 0; i++ {
+			if i%10000 == 0 && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s := h[0]
+			smpl := s.at()
+			if err := app.append(ctx, smpl); err != nil {
+				return err
+			}
+			if s.next() {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+		return nil
+	})
+	return eg.Wait()
 }
 
-func getCompatibleBlockDuration(maxBlockDuration int64) int64 {
-	blockDuration := tsdb.DefaultBlockDuration
-	if maxBlockDuration > tsdb.DefaultBlockDuration {
-		ranges := tsdb.ExponentialBlockRanges(tsdb.DefaultBlockDuration, 10, 3)
-		idx := len(ranges) - 1 // Use largest range if user asked for something enormous.
-		for i, v := range ranges {
-			if v > maxBlockDuration {
-				idx = i - 1
-				break
+// sortInputs sorts samples of all the files by timestamp using bounded memory, and appends them to app.
+// Up to bufSize samples are sorted in memory and spilled to dir as sorted runs, which are then merged.
+func sortInputs(ctx context.Context, files []string, format inputFormat, bufSize int, dir string, app sampleAppender, stats *skippedEntries, logger log.Logger) (err error) {
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return fmt.Errorf("create sort dir: %w", err)
+	}
+	defer func() {
+		err = tsdb_errors.NewMulti(err, os.RemoveAll(dir)).Err()
+	}()
+
+	sa := &sortAppender{dir: dir, size: bufSize}
+	for _, file := range files {
+		if err := parseInput(ctx, file, format, inputChunkSize, sa, stats); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	sa.sort()
+	if len(sa.runs) == 0 {
+		// everything fits in memory
+		for _, smpl := range sa.buf {
+			if err := app.append(ctx, smpl); err != nil {
+				return err
 			}
 		}
-		blockDuration = ranges[idx]
+		return nil
 	}
-	return blockDuration
+
+	if err := sa.spill(); err != nil {
+		return err
+	}
+	return mergeRuns(ctx, dir, sa.runs, mergeFanIn, app, logger)
 }
 
-// https://github.com/prometheus/prometheus/blob/main/cmd/promtool/backfill.go#L87
-func createBlocks(input []byte, mint, maxt, maxBlockDuration int64, maxSamplesInAppender int, outputDir string, humanReadable bool, lbls labels.Labels, logger log.Logger) (ids []ulid.ULID, returnErr error) {
-	blockDuration := getCompatibleBlockDuration(maxBlockDuration)
-	mint = blockDuration * (mint / blockDuration)
+// mergeRuns merges sorted run files and appends their samples to app. To bound number of open files and memory,
+// runs are merged by fanIn at a time to new runs in dir, until at most fanIn runs are left for the final merge.
+// Merged runs are deleted.
+func mergeRuns(ctx context.Context, dir string, runs []string, fanIn int, app sampleAppender, logger log.Logger) error {
+	for pass := 1; len(runs) > fanIn; pass++ {
+		level.Info(logger).Log("msg", "merging sorted runs", "runs", len(runs), "pass", pass)
+		var next []string
+		for i := 0; i < len(runs); i += fanIn {
+			group := runs[i:min(i+fanIn, len(runs))]
+			name := filepath.Join(dir, fmt.Sprintf("run-%d-%06d", pass, len(next)))
+			err := writeRun(name, func(w sampleAppender) error {
+				return mergeSorted(ctx, runProducers(group), w)
+			})
+			if err != nil {
+				return err
+			}
+			for _, run := range group {
+				if err := os.Remove(run); err != nil {
+					return fmt.Errorf("remove sort run: %w", err)
+				}
+			}
+			next = append(next, name)
+		}
+		runs = next
+	}
+	level.Info(logger).Log("msg", "merging sorted runs", "runs", len(runs))
+	return mergeSorted(ctx, runProducers(runs), app)
+}
 
-	db, err := tsdb.OpenDBReadOnly(outputDir, nil)
+// runProducers returns producers reading given sorted run files
+func runProducers(runs []string) []func(context.Context, sampleAppender) error {
+	producers := make([]func(context.Context, sampleAppender) error, len(runs))
+	for i, run := range runs {
+		run := run
+		producers[i] = func(ctx context.Context, app sampleAppender) error {
+			return readRun(ctx, run, app)
+		}
+	}
+	return producers
+}
+
+// sortAppender collects samples to buffer, and spills them to disk sorted by timestamp when the buffer is full
+type sortAppender struct {
+	dir  string
+	size int
+	buf  []sample
+	runs []string
+}
+
+func (s *sortAppender) append(_ context.Context, smpl sample) error {
+	s.buf = append(s.buf, smpl)
+	if len(s.buf) < s.size {
+		return nil
+	}
+	s.sort()
+	return s.spill()
+}
+
+// sort keeps original order of samples with the same timestamp
+func (s *sortAppender) sort() {
+	slices.SortStableFunc(s.buf, func(a, b sample) int {
+		return cmp.Compare(a.t, b.t)
+	})
+}
+
+// spill writes sorted buffer to a new run file
+func (s *sortAppender) spill() error {
+	name := filepath.Join(s.dir, fmt.Sprintf("run-%06d", len(s.runs)))
+	err := writeRun(name, func(w sampleAppender) error {
+		for _, smpl := range s.buf {
+			if err := w.append(context.Background(), smpl); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	s.runs = append(s.runs, name)
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// writeRun creates run file with samples appended by produce, which should be sorted by timestamp
+func writeRun(name string, produce func(sampleAppender) error) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("create sort run: %w", err)
 	}
 	defer func() {
-		returnErr = tsdb_errors.NewMulti(returnErr, db.Close()).Err()
+		err = tsdb_errors.NewMulti(err, f.Close()).Err()
 	}()
+	w := &runWriter{w: bufio.NewWriterSize(f, 1<<20)}
+	if err := produce(w); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("write sort run: %w", err)
+	}
+	return nil
+}
+
+// runWriter encodes samples to run file
+type runWriter struct {
+	w *bufio.Writer
+	b []byte
+}
+
+func (r *runWriter) append(_ context.Context, smpl sample) error {
+	r.b = encodeSample(r.b[:0], smpl)
+	if _, err := r.w.Write(r.b); err != nil {
+		return fmt.Errorf("write sort run: %w", err)
+	}
+	return nil
+}
+
+// readRun appends samples from sorted run file to app
+func readRun(ctx context.Context, name string, app sampleAppender) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("open sort run: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1<<20)
+	for {
+		smpl, err := decodeSample(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read sort run %s: %w", name, err)
+		}
+		if err := app.append(ctx, smpl); err != nil {
+			return err
+		}
+	}
+}
+
+// encodeSample appends binary representation of sample to b:
+// number of labels, (name length, name, value length, value) for each label, timestamp, kind byte, value bits.
+// Histogram samples have text representation length and text instead of value bits.
+func encodeSample(b []byte, s sample) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s.l)))
+	for _, l := range s.l {
+		b = binary.AppendUvarint(b, uint64(len(l.Name)))
+		b = append(b, l.Name...)
+		b = binary.AppendUvarint(b, uint64(len(l.Value)))
+		b = append(b, l.Value...)
+	}
+	b = binary.AppendVarint(b, s.t)
+	if s.h == nil && s.fh == nil {
+		b = append(b, 0)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(s.v))
+	}
+	text := formatHistogram(s.h, s.fh)
+	b = append(b, 1)
+	b = binary.AppendUvarint(b, uint64(len(text)))
+	return append(b, text...)
+}
+
+func decodeSample(r *bufio.Reader) (s sample, err error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return s, err // io.EOF at the record boundary
+	}
+	readString := func() (string, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+	sb := labels.NewScratchBuilder(int(n))
+	for i := uint64(0); i < n; i++ {
+		name, err := readString()
+		if err != nil {
+			return s, noEOF(err)
+		}
+		value, err := readString()
+		if err != nil {
+			return s, noEOF(err)
+		}
+		sb.Add(name, value)
+	}
+	s.l = sb.Labels()
+	if s.t, err = binary.ReadVarint(r); err != nil {
+		return s, noEOF(err)
+	}
+	kind, err := r.ReadByte()
+	if err != nil {
+		return s, noEOF(err)
+	}
+	if kind != 0 {
+		text, err := readString()
+		if err != nil {
+			return s, noEOF(err)
+		}
+		s.h, s.fh, err = parseHistogram(text)
+		return s, err
+	}
+	var v [8]byte
+	if _, err := io.ReadFull(r, v[:]); err != nil {
+		return s, noEOF(err)
+	}
+	s.v = math.Float64frombits(binary.LittleEndian.Uint64(v[:]))
+	return s, nil
+}
+
+// noEOF converts EOF in the middle of a record to error
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// batchAppender sends samples to channel by batches
+type batchAppender struct {
+	ch    chan<- []sample
+	batch []sample
+}
+
+func (b *batchAppender) append(ctx context.Context, s sample) error {
+	b.batch = append(b.batch, s)
+	if len(b.batch) < 1000 {
+		return nil
+	}
+	return b.flush(ctx)
+}
+
+func (b *batchAppender) flush(ctx context.Context) error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+	select {
+	case b.ch <- b.batch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	b.batch = nil
+	return nil
+}
+
+// sampleStream reads batches of samples from channel one by one
+type sampleStream struct {
+	ch    <-chan []sample
+	batch []sample
+	pos   int
+}
+
+func (s *sampleStream) next() bool {
+	s.pos++
+	for s.pos >= len(s.batch) {
+		batch, ok := <-s.ch
+		if !ok {
+			return false
+		}
+		s.batch, s.pos = batch, 0
+	}
+	return true
+}
+
+func (s *sampleStream) at() sample {
+	return s.batch[s.pos]
+}
 
-	var (
-		wroteHeader  bool
-		nextSampleTs int64 = math.MaxInt64
-	)
+// sampleHeap orders streams by timestamp of their current sample
+type sampleHeap []*sampleStream
 
-	for t := mint; t <= maxt; t += blockDuration {
-		tsUpper := t + blockDuration
-		if nextSampleTs != math.MaxInt64 && nextSampleTs >= tsUpper {
-			// The next sample is not in this timerange, we can avoid parsing
-			// the file for this timerange.
+func (h sampleHeap) Len() int           { return len(h) }
+func (h sampleHeap) Less(i, j int) bool { return h[i].at().t < h[j].at().t }
+func (h sampleHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sampleHeap) Push(x any)        { *h = append(*h, x.(*sampleStream)) }
+func (h *sampleHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// parseText appends all the samples from text parser to app
+func parseText(ctx context.Context, p textparse.Parser, format string, app sampleAppender, stats *skippedEntries) error {
+	var e exemplar.Exemplar
+	for i := 0; ; i++ {
+		if i%10000 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("parse: %w", err)
+		}
+		switch entry {
+		case textparse.EntrySeries:
+		case textparse.EntryType, textparse.EntryHelp, textparse.EntryUnit:
+			stats.metadata++
+			continue
+		case textparse.EntryComment:
 			continue
+		default:
+			return fmt.Errorf("unsupported entry type %d in %s input", entry, format)
 		}
-		nextSampleTs = math.MaxInt64
 
-		err := func() error {
-			// To prevent races with compaction, a block writer only allows appending samples
-			// that are at most half a block size older than the most recent sample appended so far.
-			// However, in the way we use the block writer here, compaction doesn't happen, while we
-			// also need to append samples throughout the whole block range. To allow that, we
-			// pretend that the block is twice as large here, but only really add sample in the
-			// original interval later.
-			w, err := tsdb.NewBlockWriter(logger, outputDir, 2*blockDuration)
-			if err != nil {
-				return fmt.Errorf("block writer: %w", err)
+		l := labels.Labels{}
+		p.Metric(&l)
+		_, ts, v := p.Series()
+		if ts == nil {
+			return fmt.Errorf("expected timestamp for series %v, got none", l)
+		}
+		if err := app.append(ctx, sample{l: l, t: *ts, v: v}); err != nil {
+			return err
+		}
+		if p.Exemplar(&e) {
+			stats.exemplars++
+		}
+	}
+}
+
+// parsePromText parses text format extended with native histogram samples as written by dump, which are not
+// supported by textparse. Lines with histograms are parsed separately, keeping the order of samples.
+func parsePromText(ctx context.Context, chunk []byte, app sampleAppender, stats *skippedEntries) error {
+	for {
+		i := bytes.Index(chunk, histogramPrefix)
+		if i < 0 {
+			return parseText(ctx, textparse.NewPromParser(chunk), "prom", app, stats)
+		}
+		start := bytes.LastIndexByte(chunk[:i], '\n') + 1
+		end := len(chunk)
+		if j := bytes.IndexByte(chunk[i:], '\n'); j >= 0 {
+			end = i + j + 1
+		}
+		s, ok, err := parseHistogramLine(string(chunk[start:end]))
+		if err != nil {
+			return fmt.Errorf("parse: %w", err)
+		}
+		if !ok {
+			// prefix is a part of label value, not a histogram
+			if err := parseText(ctx, textparse.NewPromParser(chunk[:end]), "prom", app, stats); err != nil {
+				return err
 			}
-			defer func() {
-				err = tsdb_errors.NewMulti(err, w.Close()).Err()
-			}()
-
-			ctx := context.Background()
-			app := w.Appender(ctx)
-			p := textparse.NewPromParser(input)
-			samplesCount := 0
-			for {
-				e, err := p.Next()
-				if errors.Is(err, io.EOF) {
-					break
-				}
-				if err != nil {
-					return fmt.Errorf("parse: %w", err)
-				}
-				if e != textparse.EntrySeries {
-					continue
-				}
+			chunk = chunk[end:]
+			continue
+		}
+		if err := parseText(ctx, textparse.NewPromParser(chunk[:start]), "prom", app, stats); err != nil {
+			return err
+		}
+		if err := app.append(ctx, s); err != nil {
+			return err
+		}
+		chunk = chunk[end:]
+	}
+}
 
-				_, ts, v := p.Series()
-				if ts == nil {
-					l := labels.Labels{}
-					p.Metric(&l)
-					return fmt.Errorf("expected timestamp for series %v, got none", l)
-				}
-				if *ts < t {
-					continue
-				}
-				if *ts >= tsUpper {
-					if *ts < nextSampleTs {
-						nextSampleTs = *ts
-					}
-					continue
-				}
+var histogramPrefix = []byte("{type:")
 
-				l := labels.Labels{}
-				p.Metric(&l)
+// parseHistogramLine parses `series {type:...} timestamp` line, ok is false when the value is not a histogram
+func parseHistogramLine(line string) (s sample, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	// series ends at the first space outside of labels
+	end, inLabels, inQuotes := len(line), false, false
+	for i := 0; i < len(line) && end == len(line); i++ {
+		switch c := line[i]; {
+		case inQuotes && c == '\\':
+			i++
+		case inQuotes && c == '"':
+			inQuotes = false
+		case inQuotes:
+		case c == '"' && inLabels:
+			inQuotes = true
+		case c == '{':
+			inLabels = true
+		case c == '}':
+			inLabels = false
+		case (c == ' ' || c == '\t') && !inLabels:
+			end = i
+		}
+	}
+	series, rest := line[:end], strings.TrimLeft(line[end:], " \t")
+	if !strings.HasPrefix(rest, string(histogramPrefix)) {
+		return s, false, nil
+	}
+	i := strings.IndexByte(rest, '}')
+	if i < 0 {
+		return s, true, fmt.Errorf("unterminated histogram in line %q", line)
+	}
+	value, ts := rest[:i+1], strings.TrimSpace(rest[i+1:])
+	if ts == "" {
+		return s, true, fmt.Errorf("expected timestamp for series %s, got none", series)
+	}
+	if s.t, err = strconv.ParseInt(ts, 10, 64); err != nil {
+		return s, true, fmt.Errorf("invalid timestamp in line %q: %w", line, err)
+	}
+	if s.l, err = parser.ParseMetric(series); err != nil {
+		return s, true, fmt.Errorf("invalid series in line %q: %w", line, err)
+	}
+	if s.h, s.fh, err = parseHistogram(value); err != nil {
+		return s, true, fmt.Errorf("invalid histogram in line %q: %w", line, err)
+	}
+	return s, true, nil
+}
 
-				if _, err := app.Append(0, l, *ts, v); err != nil {
-					return fmt.Errorf("add sample: %w", err)
-				}
+var counterResetHints = map[string]histogram.CounterResetHint{
+	"unknown":   histogram.UnknownCounterReset,
+	"reset":     histogram.CounterReset,
+	"not_reset": histogram.NotCounterReset,
+	"gauge":     histogram.GaugeType,
+}
 
-				samplesCount++
-				if samplesCount < maxSamplesInAppender {
-					continue
-				}
+// parseHistogram parses native histogram in the format of formatHistogram
+func parseHistogram(text string) (*histogram.Histogram, *histogram.FloatHistogram, error) {
+	if !strings.HasPrefix(text, "{") || !strings.HasSuffix(text, "}") {
+		return nil, nil, errors.New("histogram should be enclosed in {}")
+	}
+	fh := &histogram.FloatHistogram{}
+	typ := ""
+	for rest := text[1 : len(text)-1]; rest != ""; {
+		key, value, ok := strings.Cut(rest, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("expected key:value, got %q", rest)
+		}
+		if strings.HasPrefix(value, "[") {
+			// lists contain commas
+			value, rest, _ = strings.Cut(value, "]")
+			value += "]"
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+		}
 
-				// If we arrive here, the samples count is greater than the maxSamplesInAppender.
-				// Therefore the old appender is committed and a new one is created.
-				// This prevents keeping too many samples lined up in an appender and thus in RAM.
-				if err := app.Commit(); err != nil {
-					return fmt.Errorf("commit: %w", err)
-				}
+		var err error
+		switch key {
+		case "type":
+			typ = value
+		case "schema":
+			var v int64
+			v, err = strconv.ParseInt(value, 10, 32)
+			fh.Schema = int32(v)
+		case "count":
+			fh.Count, err = strconv.ParseFloat(value, 64)
+		case "sum":
+			fh.Sum, err = strconv.ParseFloat(value, 64)
+		case "zero_threshold":
+			fh.ZeroThreshold, err = strconv.ParseFloat(value, 64)
+		case "zero_count":
+			fh.ZeroCount, err = strconv.ParseFloat(value, 64)
+		case "counter_reset_hint":
+			if fh.CounterResetHint, ok = counterResetHints[value]; !ok {
+				err = errors.New("unknown hint")
+			}
+		case "positive_spans":
+			fh.PositiveSpans, err = parseSpans(value)
+		case "negative_spans":
+			fh.NegativeSpans, err = parseSpans(value)
+		case "positive_buckets":
+			fh.PositiveBuckets, err = parseBuckets(value)
+		case "negative_buckets":
+			fh.NegativeBuckets, err = parseBuckets(value)
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s %q: %w", key, value, err)
+		}
+	}
+	if err := checkSpans(fh.PositiveSpans, len(fh.PositiveBuckets)); err != nil {
+		return nil, nil, fmt.Errorf("positive buckets: %w", err)
+	}
+	if err := checkSpans(fh.NegativeSpans, len(fh.NegativeBuckets)); err != nil {
+		return nil, nil, fmt.Errorf("negative buckets: %w", err)
+	}
 
-				app = w.Appender(ctx)
-				samplesCount = 0
+	switch typ {
+	case "float":
+		return nil, fh, nil
+	case "int":
+		counts := append([]float64{fh.Count, fh.ZeroCount}, fh.PositiveBuckets...)
+		counts = append(counts, fh.NegativeBuckets...)
+		for _, c := range counts {
+			if c < 0 || c != math.Trunc(c) || c >= math.MaxInt64 {
+				return nil, nil, fmt.Errorf("int histogram should have non-negative integer counts, got %g", c)
 			}
+		}
+		return &histogram.Histogram{
+			CounterResetHint: fh.CounterResetHint,
+			Schema:           fh.Schema,
+			ZeroThreshold:    fh.ZeroThreshold,
+			ZeroCount:        uint64(fh.ZeroCount),
+			Count:            uint64(fh.Count),
+			Sum:              fh.Sum,
+			PositiveSpans:    fh.PositiveSpans,
+			NegativeSpans:    fh.NegativeSpans,
+			PositiveBuckets:  deltaBuckets(fh.PositiveBuckets),
+			NegativeBuckets:  deltaBuckets(fh.NegativeBuckets),
+		}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown histogram type %q, should be int or float", typ)
+}
+
+func parseSpans(value string) ([]histogram.Span, error) {
+	items, err := listItems(value)
+	if err != nil {
+		return nil, err
+	}
+	spans := make([]histogram.Span, 0, len(items))
+	for _, s := range items {
+		offset, length, ok := strings.Cut(s, ":")
+		if !ok {
+			return nil, fmt.Errorf("span %q should be offset:length", s)
+		}
+		o, err := strconv.ParseInt(offset, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		l, err := strconv.ParseUint(length, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, histogram.Span{Offset: int32(o), Length: uint32(l)})
+	}
+	return spans, nil
+}
+
+func parseBuckets(value string) ([]float64, error) {
+	items, err := listItems(value)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]float64, 0, len(items))
+	for _, s := range items {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, v)
+	}
+	return buckets, nil
+}
+
+// listItems returns items of [a,b,c] list
+func listItems(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return nil, errors.New("list should be enclosed in []")
+	}
+	if value = value[1 : len(value)-1]; value == "" {
+		return nil, nil
+	}
+	return strings.Split(value, ","), nil
+}
+
+// checkSpans verifies that spans cover exactly n buckets
+func checkSpans(spans []histogram.Span, n int) error {
+	total := 0
+	for _, s := range spans {
+		total += int(s.Length)
+	}
+	if total != n {
+		return fmt.Errorf("spans length %d does not match number of buckets %d", total, n)
+	}
+	return nil
+}
+
+// deltaBuckets converts absolute bucket counts to delta encoding of int histogram
+func deltaBuckets(counts []float64) []int64 {
+	res := make([]int64, len(counts))
+	var prev int64
+	for i, c := range counts {
+		res[i] = int64(c) - prev
+		prev = int64(c)
+	}
+	return res
+}
 
-			if err := app.Commit(); err != nil {
-				return fmt.Errorf("commit: %w", err)
+// parseRemoteWrite appends all the samples from stream of remote-write requests,
+// each one is snappy compressed prompb.WriteRequest prefixed by uvarint length
+func parseRemoteWrite(ctx context.Context, r io.Reader, app sampleAppender, stats *skippedEntries) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	var compressed, buf []byte
+	for n := 1; ; n++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		size, err := binary.ReadUvarint(br)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read request %d: %w", n, err)
+		}
+		if size > math.MaxInt32 {
+			return fmt.Errorf("read request %d: invalid size %d", n, size)
+		}
+		compressed = slices.Grow(compressed[:0], int(size))[:size]
+		if _, err := io.ReadFull(br, compressed); err != nil {
+			return fmt.Errorf("read request %d: %w", n, noEOF(err))
+		}
+		if buf, err = snappy.Decode(buf[:cap(buf)], compressed); err != nil {
+			return fmt.Errorf("decompress request %d: %w", n, err)
+		}
+		var req prompb.WriteRequest
+		if err := req.Unmarshal(buf); err != nil {
+			return fmt.Errorf("unmarshal request %d: %w", n, err)
+		}
+		stats.metadata += len(req.Metadata)
+		for _, ts := range req.Timeseries {
+			if err := appendTimeSeries(ctx, ts, app); err != nil {
+				return err
 			}
+			stats.exemplars += len(ts.Exemplars)
+		}
+	}
+}
 
-			blk, err := w.Flush(ctx)
-			switch {
-			case err == nil:
-				ids = append(ids, blk)
-				blocks, err := db.Blocks()
-				if err != nil {
-					return fmt.Errorf("get blocks: %w", err)
-				}
-				for _, b := range blocks {
-					if b.Meta().ULID == blk {
-						if err = writeThanosMeta(b.Meta(), lbls.Map(), 0, outputDir, logger); err != nil {
-							return fmt.Errorf("write metadata: %w", err)
-						}
-						printBlocks([]tsdb.BlockReader{b}, !wroteHeader, humanReadable)
-						wroteHeader = true
-						break
-					}
-				}
-			case errors.Is(err, tsdb.ErrNoSeriesAppended):
-			default:
-				return fmt.Errorf("flush: %w", err)
+// appendTimeSeries appends float and histogram samples of remote-write series to app ordered by timestamp
+func appendTimeSeries(ctx context.Context, ts prompb.TimeSeries, app sampleAppender) error {
+	sb := labels.NewScratchBuilder(len(ts.Labels))
+	for _, l := range ts.Labels {
+		sb.Add(l.Name, l.Value)
+	}
+	sb.Sort()
+	l := sb.Labels()
+
+	i, j := 0, 0
+	for i < len(ts.Samples) || j < len(ts.Histograms) {
+		s := sample{l: l}
+		if j == len(ts.Histograms) || (i < len(ts.Samples) && ts.Samples[i].Timestamp <= ts.Histograms[j].Timestamp) {
+			s.t, s.v = ts.Samples[i].Timestamp, ts.Samples[i].Value
+			i++
+		} else {
+			s.t = ts.Histograms[j].Timestamp
+			s.h, s.fh = histogramFromProto(ts.Histograms[j])
+			j++
+		}
+		if err := app.append(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// histogramFromProto converts remote-write histogram to int or float one
+// https://github.com/prometheus/prometheus/blob/main/storage/remote/codec.go#L633
+func histogramFromProto(hp prompb.Histogram) (*histogram.Histogram, *histogram.FloatHistogram) {
+	if hp.IsFloatHistogram() {
+		return nil, &histogram.FloatHistogram{
+			CounterResetHint: histogram.CounterResetHint(hp.ResetHint),
+			Schema:           hp.Schema,
+			ZeroThreshold:    hp.ZeroThreshold,
+			ZeroCount:        hp.GetZeroCountFloat(),
+			Count:            hp.GetCountFloat(),
+			Sum:              hp.Sum,
+			PositiveSpans:    spansFromProto(hp.PositiveSpans),
+			PositiveBuckets:  hp.PositiveCounts,
+			NegativeSpans:    spansFromProto(hp.NegativeSpans),
+			NegativeBuckets:  hp.NegativeCounts,
+		}
+	}
+	return &histogram.Histogram{
+		CounterResetHint: histogram.CounterResetHint(hp.ResetHint),
+		Schema:           hp.Schema,
+		ZeroThreshold:    hp.ZeroThreshold,
+		ZeroCount:        hp.GetZeroCountInt(),
+		Count:            hp.GetCountInt(),
+		Sum:              hp.Sum,
+		PositiveSpans:    spansFromProto(hp.PositiveSpans),
+		PositiveBuckets:  hp.PositiveDeltas,
+		NegativeSpans:    spansFromProto(hp.NegativeSpans),
+		NegativeBuckets:  hp.NegativeDeltas,
+	}, nil
+}
+
+func spansFromProto(s []prompb.BucketSpan) []histogram.Span {
+	spans := make([]histogram.Span, len(s))
+	for i, span := range s {
+		spans[i] = histogram.Span{Offset: span.Offset, Length: span.Length}
+	}
+	return spans
+}
+
+// csvConfig maps CSV columns to samples
+type csvConfig struct {
+	name         string // static metric name, or
+	nameColumn   string
+	valueColumn  string
+	timeColumn   string
+	timeFormat   string   // rfc3339, unix, unix-ms or Go time layout
+	labelColumns []string // column or label=column, all the other columns when empty
+	delimiter    string
+}
+
+func (c csvConfig) validate() error {
+	if (c.name == "") == (c.nameColumn == "") {
+		return errors.New("either --csv-name or --csv-name-column should be set for csv input")
+	}
+	if c.name != "" && !model.IsValidMetricName(model.LabelValue(c.name)) {
+		return fmt.Errorf("invalid metric name %q", c.name)
+	}
+	if utf8.RuneCountInString(c.delimiter) != 1 {
+		return fmt.Errorf("csv delimiter should be a single character, got %q", c.delimiter)
+	}
+	return nil
+}
+
+// csvLabel is a label taken from CSV column
+type csvLabel struct {
+	name   string
+	column int
+}
+
+// parseCSV appends samples from CSV with header row to app, one sample per row
+func parseCSV(ctx context.Context, input io.Reader, c csvConfig, app sampleAppender) error {
+	r := csv.NewReader(input)
+	r.Comma, _ = utf8.DecodeRuneInString(c.delimiter)
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("read csv header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, h := range header {
+		columns[strings.TrimSpace(h)] = i
+	}
+	column := func(name string) (int, error) {
+		i, ok := columns[name]
+		if !ok {
+			return 0, fmt.Errorf("column %q not found in csv header %v", name, header)
+		}
+		return i, nil
+	}
+
+	nameCol := -1
+	if c.nameColumn != "" {
+		if nameCol, err = column(c.nameColumn); err != nil {
+			return err
+		}
+	}
+	valueCol, err := column(c.valueColumn)
+	if err != nil {
+		return err
+	}
+	timeCol, err := column(c.timeColumn)
+	if err != nil {
+		return err
+	}
+	var lbls []csvLabel
+	if len(c.labelColumns) == 0 {
+		for i, h := range header {
+			if i != nameCol && i != valueCol && i != timeCol {
+				lbls = append(lbls, csvLabel{name: strings.TrimSpace(h), column: i})
 			}
+		}
+	}
+	for _, lc := range c.labelColumns {
+		name, col, ok := strings.Cut(lc, "=")
+		if !ok {
+			col = name
+		}
+		i, err := column(col)
+		if err != nil {
+			return err
+		}
+		lbls = append(lbls, csvLabel{name: name, column: i})
+	}
+	for _, l := range lbls {
+		if !model.LabelName(l.name).IsValid() || l.name == labels.MetricName {
+			return fmt.Errorf("invalid label name %q, use --csv-label-column=<label>=<column> to rename", l.name)
+		}
+	}
 
+	sb := labels.NewScratchBuilder(len(lbls) + 1)
+	for i := 0; ; i++ {
+		if i%10000 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
 			return nil
-		}()
+		}
+		if err != nil {
+			return fmt.Errorf("read csv: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+
+		sb.Reset()
+		name := c.name
+		if nameCol >= 0 {
+			name = record[nameCol]
+		}
+		sb.Add(labels.MetricName, name)
+		for _, l := range lbls {
+			// empty label is the same as no label
+			if v := record[l.column]; v != "" {
+				sb.Add(l.name, v)
+			}
+		}
+		sb.Sort()
+		v, err := strconv.ParseFloat(strings.TrimSpace(record[valueCol]), 64)
+		if err != nil {
+			return fmt.Errorf("csv line %d: invalid value: %w", line, err)
+		}
+		t, err := parseCSVTime(strings.TrimSpace(record[timeCol]), c.timeFormat)
+		if err != nil {
+			return fmt.Errorf("csv line %d: invalid timestamp: %w", line, err)
+		}
+		if err := app.append(ctx, sample{l: sb.Labels(), t: t, v: v}); err != nil {
+			return err
+		}
+	}
+}
+
+// parseCSVTime returns timestamp in milliseconds
+func parseCSVTime(s, format string) (int64, error) {
+	switch format {
+	case "unix":
+		f, err := strconv.ParseFloat(s, 64)
+		return int64(math.Round(f * 1000)), err
+	case "unix-ms":
+		return strconv.ParseInt(s, 10, 64)
+	case "rfc3339":
+		format = time.RFC3339Nano
+	}
+	t, err := time.Parse(format, s)
+	return t.UnixMilli(), err
+}
+
+// openInput opens file or stdin for "-". Compressed input (gzip, zstd) is detected by magic bytes
+func openInput(file string) (io.ReadCloser, error) {
+	f := os.Stdin
+	if file != "-" {
+		var err error
+		if f, err = os.Open(file); err != nil {
+			return nil, err
+		}
+	}
+	br := bufio.NewReaderSize(f, 1<<20)
+	magic, err := br.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		f.Close()
+		return nil, fmt.Errorf("read %s: %w", file, err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("gzip %s: %w", file, err)
+		}
+		return &inputReader{Reader: zr, closers: []io.Closer{zr, f}}, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("zstd %s: %w", file, err)
+		}
+		rc := zr.IOReadCloser()
+		return &inputReader{Reader: rc, closers: []io.Closer{rc, f}}, nil
+	}
+	return &inputReader{Reader: br, closers: []io.Closer{f}}, nil
+}
+
+// inputReader closes decompressor along with the underlying file
+type inputReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *inputReader) Close() error {
+	errs := tsdb_errors.NewMulti()
+	for _, c := range r.closers {
+		errs.Add(c.Close())
+	}
+	return errs.Err()
+}
+
+// readChunks reads input by chunks of about size bytes cut at the end of line, so that each chunk could be parsed
+// separately. The buffer is reused, so fn should not keep the chunk.
+func readChunks(r io.Reader, size int, fn func(chunk []byte, last bool) error) error {
+	buf := make([]byte, size)
+	n := 0
+	for {
+		m, err := io.ReadFull(r, buf[n:])
+		n += m
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fn(buf[:n:n], true)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("process blocks: %w", err)
+			return err
 		}
+		i := bytes.LastIndexByte(buf[:n], '\n')
+		if i < 0 {
+			// line is longer than the buffer
+			buf = append(buf, make([]byte, len(buf))...)
+			continue
+		}
+		if err := fn(buf[:i+1:i+1], false); err != nil {
+			return err
+		}
+		n = copy(buf, buf[i+1:n])
+	}
+}
+
+// blockWriters routes samples to a separate BlockWriter per block time range (window). When there are more than maxOpen
+// windows in progress, the least recently used one is flushed to disk as partial block to bound memory usage.
+// Partial blocks of the same window are compacted together on flush.
+type blockWriters struct {
+	dir                  string
+	blockDuration        int64
+	maxSamplesInAppender int
+	maxOpen              int
+	logger               log.Logger
+	open                 map[int64]*windowWriter
+	parts                map[int64][]ulid.ULID // flushed blocks by window start
+	tick                 uint64
+}
+
+type windowWriter struct {
+	writer   *tsdb.BlockWriter
+	appender storage.Appender
+	samples  int
+	lastUsed uint64
+}
+
+func newBlockWriters(dir string, blockDuration int64, maxSamplesInAppender, maxOpen int, logger log.Logger) *blockWriters {
+	return &blockWriters{
+		dir:                  dir,
+		blockDuration:        blockDuration,
+		maxSamplesInAppender: maxSamplesInAppender,
+		maxOpen:              maxOpen,
+		logger:               logger,
+		open:                 map[int64]*windowWriter{},
+		parts:                map[int64][]ulid.ULID{},
+	}
+}
+
+// windowStart returns start of aligned block time range for timestamp t
+func (b *blockWriters) windowStart(t int64) int64 {
+	start := t - t%b.blockDuration
+	if t < 0 && t%b.blockDuration != 0 {
+		start -= b.blockDuration
+	}
+	return start
+}
+
+func (b *blockWriters) append(ctx context.Context, s sample) error {
+	w, err := b.window(ctx, b.windowStart(s.t))
+	if err != nil {
+		return err
+	}
+	if s.h != nil || s.fh != nil {
+		_, err = w.appender.AppendHistogram(0, s.l, s.t, s.h, s.fh)
+	} else {
+		_, err = w.appender.Append(0, s.l, s.t, s.v)
+	}
+	if err != nil {
+		return fmt.Errorf("add sample %v %d: %w", s.l, s.t, err)
+	}
+	return b.commitIfFull(ctx, w)
+}
+
+// commitIfFull commits appender after maxSamplesInAppender samples,
+// this prevents keeping too many samples lined up in an appender and thus in RAM
+func (b *blockWriters) commitIfFull(ctx context.Context, w *windowWriter) error {
+	w.samples++
+	if w.samples < b.maxSamplesInAppender {
+		return nil
 	}
+	if err := w.appender.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	w.appender = w.writer.Appender(ctx)
+	w.samples = 0
+	return nil
+}
+
+// window returns writer for the window, opening a new one (and flushing the least recently used) if needed
+func (b *blockWriters) window(ctx context.Context, start int64) (*windowWriter, error) {
+	b.tick++
+	if w, ok := b.open[start]; ok {
+		w.lastUsed = b.tick
+		return w, nil
+	}
+	if len(b.open) >= b.maxOpen {
+		lru := int64(0)
+		for s, w := range b.open {
+			if _, ok := b.open[lru]; !ok || w.lastUsed < b.open[lru].lastUsed {
+				lru = s
+			}
+		}
+		level.Debug(b.logger).Log("msg", "too many open blocks, flushing partial block", "start", lru)
+		if err := b.flushWindow(ctx, lru); err != nil {
+			return nil, err
+		}
+	}
+
+	// To prevent races with compaction, a block writer only allows appending samples
+	// that are at most half a block size older than the most recent sample appended so far.
+	// However, in the way we use the block writer here, compaction doesn't happen, while we
+	// also need to append samples throughout the whole block range. To allow that, we
+	// pretend that the block is twice as large here, but only really add sample in the
+	// original interval.
+	w, err := tsdb.NewBlockWriter(b.logger, b.dir, 2*b.blockDuration)
+	if err != nil {
+		return nil, fmt.Errorf("block writer: %w", err)
+	}
+	ww := &windowWriter{writer: w, appender: w.Appender(ctx), lastUsed: b.tick}
+	b.open[start] = ww
+	return ww, nil
+}
+
+// flushWindow writes open window to disk as a block
+func (b *blockWriters) flushWindow(ctx context.Context, start int64) (err error) {
+	w := b.open[start]
+	delete(b.open, start)
+	defer func() {
+		err = tsdb_errors.NewMulti(err, w.writer.Close()).Err()
+	}()
+	if err := w.appender.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	id, err := w.writer.Flush(ctx)
+	switch {
+	case err == nil:
+		b.parts[start] = append(b.parts[start], id)
+	case errors.Is(err, tsdb.ErrNoSeriesAppended):
+	default:
+		return fmt.Errorf("flush: %w", err)
+	}
+	return nil
+}
+
+// flush writes all open windows to disk, compacts partial blocks and returns resulting block ids sorted by time
+func (b *blockWriters) flush(ctx context.Context) ([]ulid.ULID, error) {
+	for start := range b.open {
+		if err := b.flushWindow(ctx, start); err != nil {
+			return nil, err
+		}
+	}
+
+	starts := make([]int64, 0, len(b.parts))
+	for s := range b.parts {
+		starts = append(starts, s)
+	}
+	slices.Sort(starts)
+	var compactor *tsdb.LeveledCompactor
+	ids := make([]ulid.ULID, 0, len(starts))
+	for _, start := range starts {
+		parts := b.parts[start]
+		if len(parts) == 1 {
+			ids = append(ids, parts[0])
+			continue
+		}
+		if compactor == nil {
+			var err error
+			compactor, err = tsdb.NewLeveledCompactor(ctx, nil, b.logger, []int64{b.blockDuration}, chunkenc.NewPool(), nil)
+			if err != nil {
+				return nil, fmt.Errorf("create compactor: %w", err)
+			}
+		}
+		dirs := make([]string, 0, len(parts))
+		for _, id := range parts {
+			dirs = append(dirs, filepath.Join(b.dir, id.String()))
+		}
+		id, err := compactor.Compact(b.dir, dirs, nil)
+		if err != nil {
+			return nil, fmt.Errorf("compact partial blocks %v: %w", parts, err)
+		}
+		for _, d := range dirs {
+			if err := os.RemoveAll(d); err != nil {
+				return nil, fmt.Errorf("delete partial block: %w", err)
+			}
+		}
+		ids = append(ids, id)
+	}
+	b.parts = map[int64][]ulid.ULID{}
 	return ids, nil
 }
 
+// close releases open writers without flushing them
+func (b *blockWriters) close() error {
+	errs := tsdb_errors.NewMulti()
+	for start, w := range b.open {
+		errs.Add(w.writer.Close())
+		delete(b.open, start)
+	}
+	return errs.Err()
+}
+
+// tenantWriters relabels samples and routes them to separate blockWriters for each set of labels extracted
+// via metaExtLabels, the same way as unwrap splits blocks. Relabeling results are cached by series hash,
+// up to cacheSize series, arbitrary ones are evicted when the cache is full.
+type tenantWriters struct {
+	relabelConfig []*relabel.Config
+	newWriters    func() *blockWriters
+	tenants       map[uint64]*importTenant
+	cache         map[uint64]relabeledSeries
+	cacheSize     int
+	dropped       int // samples
+}
+
+type importTenant struct {
+	extLabels labels.Labels
+	writers   *blockWriters
+}
+
+type relabeledSeries struct {
+	orig   labels.Labels
+	lbls   labels.Labels
+	tenant *importTenant // nil for dropped series
+}
+
+func newTenantWriters(relabelConfig []*relabel.Config, newWriters func() *blockWriters) *tenantWriters {
+	return &tenantWriters{
+		relabelConfig: relabelConfig,
+		newWriters:    newWriters,
+		tenants:       map[uint64]*importTenant{},
+		cache:         map[uint64]relabeledSeries{},
+		cacheSize:     relabelCacheSize,
+	}
+}
+
+func (w *tenantWriters) append(ctx context.Context, s sample) error {
+	if len(w.relabelConfig) == 0 {
+		return w.tenant(labels.EmptyLabels()).writers.append(ctx, s)
+	}
+	h := s.l.Hash()
+	rs, ok := w.cache[h]
+	if !ok || !labels.Equal(rs.orig, s.l) {
+		rs = w.relabel(s.l)
+		if !ok {
+			// do not overwrite on hash collision
+			if len(w.cache) >= w.cacheSize {
+				for k := range w.cache {
+					delete(w.cache, k)
+					break
+				}
+			}
+			w.cache[h] = rs
+		}
+	}
+	if rs.tenant == nil {
+		w.dropped++
+		return nil
+	}
+	s.l = rs.lbls
+	return rs.tenant.writers.append(ctx, s)
+}
+
+func (w *tenantWriters) relabel(l labels.Labels) relabeledSeries {
+	rl, keep := relabel.Process(l, w.relabelConfig...)
+	if !keep {
+		return relabeledSeries{orig: l}
+	}
+	lbls, extl := extractLabels(rl, strings.Split(rl.Get(metaExtLabels), ";"))
+	if lbls.IsEmpty() {
+		return relabeledSeries{orig: l}
+	}
+	return relabeledSeries{orig: l, lbls: lbls, tenant: w.tenant(extl)}
+}
+
+func (w *tenantWriters) tenant(extLabels labels.Labels) *importTenant {
+	id := extLabels.Hash()
+	if _, ok := w.tenants[id]; !ok {
+		w.tenants[id] = &importTenant{extLabels: extLabels, writers: w.newWriters()}
+	}
+	return w.tenants[id]
+}
+
+func (w *tenantWriters) close() error {
+	errs := tsdb_errors.NewMulti()
+	for _, t := range w.tenants {
+		errs.Add(t.writers.close())
+	}
+	return errs.Err()
+}
+
 func printBlocks(blocks []tsdb.BlockReader, writeHeader, humanReadable bool) {
 	tw := tabwriter.NewWriter(os.Stdout, 13, 0, 2, ' ', 0)
 	defer tw.Flush()
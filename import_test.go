@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"gopkg.in/yaml.v2"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_readChunks(t *testing.T) {
+	input := "a 1 1\nbb 2 2\nlong_line_over_buffer 3 3\nc 4 4"
+	var (
+		chunks []string
+		lasts  int
+	)
+	err := readChunks(strings.NewReader(input), 8, func(chunk []byte, last bool) error {
+		chunks = append(chunks, string(chunk))
+		if last {
+			lasts++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readChunks() error = %v", err)
+	}
+	if lasts != 1 {
+		t.Errorf("readChunks() last chunks = %d, wants 1", lasts)
+	}
+	if got := strings.Join(chunks, ""); got != input {
+		t.Errorf("readChunks() = %q, wants %q", got, input)
+	}
+	for _, c := range chunks[:len(chunks)-1] {
+		if !strings.HasSuffix(c, "\n") {
+			t.Errorf("readChunks() chunk %q is not cut at the end of line", c)
+		}
+	}
+}
+
+func Test_parseInputOpenMetrics(t *testing.T) {
+	input := "# TYPE a counter\na_total 1 1\na_total 2 2 # {trace_id=\"abc\"} 1 1.5\nb 3 3\nb 4 4\n# EOF"
+	cases := []struct {
+		name      string
+		input     string
+		chunkSize int
+		samples   int
+		exemplars int
+		expectErr bool
+	}{
+		{name: "single chunk", input: input + "\n", chunkSize: 1 << 10, samples: 4, exemplars: 1},
+		{name: "multiple chunks", input: input + "\n", chunkSize: 16, samples: 4, exemplars: 1},
+		{name: "no trailing newline", input: input, chunkSize: 1 << 10, samples: 4, exemplars: 1},
+		{name: "no trailing newline, multiple chunks", input: input, chunkSize: 16, samples: 4, exemplars: 1},
+		{name: "missing EOF", input: "a_total 1 1\nb 3 3\n", chunkSize: 1 << 10, expectErr: true},
+		{name: "missing EOF, multiple chunks", input: "a_total 1 1\nb 3 3\n", chunkSize: 12, expectErr: true},
+		{name: "data after EOF", input: input + "\nc 5 5\n", chunkSize: 1 << 10, expectErr: true},
+		{name: "data after EOF, multiple chunks", input: input + "\nc 5 5\n", chunkSize: 16, expectErr: true},
+	}
+	for _, td := range cases {
+		file := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(file, []byte(td.input), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var app testAppender
+		var stats skippedEntries
+		err := parseInput(context.Background(), file, inputFormat{name: "openmetrics"}, td.chunkSize, &app, &stats)
+		if td.expectErr {
+			if err == nil {
+				t.Errorf("parseInput(%s) should fail", td.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseInput(%s) error = %v", td.name, err)
+		}
+		if len(app) != td.samples {
+			t.Errorf("parseInput(%s) samples=%d, wants %d", td.name, len(app), td.samples)
+		}
+		if stats.exemplars != td.exemplars {
+			t.Errorf("parseInput(%s) exemplars=%d, wants %d", td.name, stats.exemplars, td.exemplars)
+		}
+	}
+}
+
+func Test_parseHistogram(t *testing.T) {
+	h := &histogram.Histogram{
+		Schema:          1,
+		ZeroThreshold:   0.001,
+		ZeroCount:       2,
+		Count:           12,
+		Sum:             18.4,
+		PositiveSpans:   []histogram.Span{{Offset: -1, Length: 2}, {Offset: 1, Length: 2}},
+		PositiveBuckets: []int64{1, 1, -1, 0},
+		NegativeSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+		NegativeBuckets: []int64{5},
+	}
+	text := formatHistogram(h, nil)
+	want := "{type:int,schema:1,count:12,sum:18.4,zero_threshold:0.001,zero_count:2,positive_spans:[-1:2,1:2],positive_buckets:[1,2,1,1],negative_spans:[0:1],negative_buckets:[5]}"
+	if text != want {
+		t.Fatalf("formatHistogram() = %s, wants %s", text, want)
+	}
+	gotH, _, err := parseHistogram(text)
+	if err != nil {
+		t.Fatalf("parseHistogram() error = %v", err)
+	}
+	if !reflect.DeepEqual(gotH, h) {
+		t.Errorf("parseHistogram() = %v, wants %v", gotH, h)
+	}
+
+	fh := h.ToFloat()
+	fh.CounterResetHint = histogram.GaugeType
+	_, gotFH, err := parseHistogram(formatHistogram(nil, fh))
+	if err != nil {
+		t.Fatalf("parseHistogram() error = %v", err)
+	}
+	if !reflect.DeepEqual(gotFH, fh) {
+		t.Errorf("parseHistogram() = %v, wants %v", gotFH, fh)
+	}
+
+	for _, text := range []string{
+		"{type:int,count:1.5}",
+		"{type:float,positive_spans:[0:2],positive_buckets:[1]}",
+		"{type:summary}",
+		"{type:int,unknown:1}",
+	} {
+		if _, _, err := parseHistogram(text); err == nil {
+			t.Errorf("parseHistogram(%s) expected error", text)
+		}
+	}
+}
+
+func Test_parseHistogramLine(t *testing.T) {
+	s, ok, err := parseHistogramLine(`metric{a="x} {type:", b="y"} {type:float,count:1,sum:1} 1000` + "\n")
+	if err != nil || !ok {
+		t.Fatalf("parseHistogramLine() = %v, %v", ok, err)
+	}
+	if s.l.String() != `{__name__="metric", a="x} {type:", b="y"}` || s.t != 1000 || s.fh == nil || s.fh.Count != 1 {
+		t.Errorf("parseHistogramLine() = %v %d %v", s.l, s.t, s.fh)
+	}
+	if _, ok, _ := parseHistogramLine(`metric{a="{type:"} 1 1000`); ok {
+		t.Errorf("parseHistogramLine() parsed float sample as histogram")
+	}
+}
+
+type testAppender []sample
+
+func (a *testAppender) append(_ context.Context, s sample) error {
+	*a = append(*a, s)
+	return nil
+}
+
+func Test_parseRemoteWrite(t *testing.T) {
+	h := &histogram.Histogram{
+		Count:           3,
+		Sum:             4.5,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []int64{1, 1},
+	}
+	reqs := []prompb.WriteRequest{{
+		Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "job", Value: "a"}, {Name: "__name__", Value: "metric"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 3000}},
+			Histograms: []prompb.Histogram{{
+				Count:          &prompb.Histogram_CountInt{CountInt: 3},
+				Sum:            4.5,
+				ZeroCount:      &prompb.Histogram_ZeroCountInt{},
+				PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 2}},
+				PositiveDeltas: []int64{1, 1},
+				Timestamp:      2000,
+			}},
+			Exemplars: []prompb.Exemplar{{Value: 1, Timestamp: 1000}},
+		}},
+		Metadata: []prompb.MetricMetadata{{MetricFamilyName: "metric", Help: "help"}},
+	}, {
+		Timeseries: []prompb.TimeSeries{{
+			Labels: []prompb.Label{{Name: "__name__", Value: "float_histogram"}},
+			Histograms: []prompb.Histogram{{
+				Count:          &prompb.Histogram_CountFloat{CountFloat: 3},
+				Sum:            4.5,
+				ZeroCount:      &prompb.Histogram_ZeroCountFloat{},
+				PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 2}},
+				PositiveCounts: []float64{1, 2},
+				Timestamp:      4000,
+			}},
+		}},
+	}}
+	var input []byte
+	for _, req := range reqs {
+		b, err := req.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = snappy.Encode(nil, b)
+		input = binary.AppendUvarint(input, uint64(len(b)))
+		input = append(input, b...)
+	}
+
+	var app testAppender
+	var stats skippedEntries
+	if err := parseRemoteWrite(context.Background(), bytes.NewReader(input), &app, &stats); err != nil {
+		t.Fatalf("parseRemoteWrite() error = %v", err)
+	}
+	if stats.metadata != 1 || stats.exemplars != 1 {
+		t.Errorf("parseRemoteWrite() skipped = %+v, wants 1 metadata and 1 exemplar", stats)
+	}
+	if len(app) != 4 {
+		t.Fatalf("parseRemoteWrite() got %d samples, wants 4", len(app))
+	}
+	for i, s := range app {
+		if s.t != int64(i+1)*1000 {
+			t.Errorf("parseRemoteWrite() sample %d timestamp = %d, wants %d", i, s.t, (i+1)*1000)
+		}
+	}
+	if app[0].l.String() != `{__name__="metric", job="a"}` || app[0].v != 1 {
+		t.Errorf("parseRemoteWrite() float sample = %v %g", app[0].l, app[0].v)
+	}
+	if app[1].h == nil || !app[1].h.Equals(h) {
+		t.Errorf("parseRemoteWrite() histogram = %v, wants %v", app[1].h, h)
+	}
+	if app[3].fh == nil || !app[3].fh.Equals(h.ToFloat()) {
+		t.Errorf("parseRemoteWrite() float histogram = %v, wants %v", app[3].fh, h.ToFloat())
+	}
+
+	if err := parseRemoteWrite(context.Background(), bytes.NewReader(input[:len(input)-1]), &app, &stats); err == nil {
+		t.Errorf("parseRemoteWrite() expected error for truncated input")
+	}
+}
+
+func Test_parseCSV(t *testing.T) {
+	input := "time;Namespace Name;cost;team\n" +
+		"2020-09-10T21:00:00Z;kube-system;5.7;\n" +
+		"2020-09-10T21:00:30.5+00:00;default;1e1;a\n"
+	c := csvConfig{
+		name:         "k8s_ns_hourly_cost",
+		valueColumn:  "cost",
+		timeColumn:   "time",
+		timeFormat:   "rfc3339",
+		labelColumns: []string{"namespace=Namespace Name", "team"},
+		delimiter:    ";",
+	}
+	var app testAppender
+	if err := parseCSV(context.Background(), strings.NewReader(input), c, &app); err != nil {
+		t.Fatalf("parseCSV() error = %v", err)
+	}
+	want := []string{
+		`{__name__="k8s_ns_hourly_cost", namespace="kube-system"} 5.7 1599771600000`,
+		`{__name__="k8s_ns_hourly_cost", namespace="default", team="a"} 10 1599771630500`,
+	}
+	if len(app) != len(want) {
+		t.Fatalf("parseCSV() got %d samples, wants %d", len(app), len(want))
+	}
+	for i, s := range app {
+		if got := fmt.Sprintf("%s %g %d", s.l, s.v, s.t); got != want[i] {
+			t.Errorf("parseCSV() = %s, wants %s", got, want[i])
+		}
+	}
+
+	// all the other columns are labels by default
+	c.labelColumns = nil
+	if err := parseCSV(context.Background(), strings.NewReader(input), c, &app); err == nil {
+		t.Errorf("parseCSV() expected error for invalid label name")
+	}
+}
+
+func Test_parseCSVTime(t *testing.T) {
+	for _, tt := range []struct {
+		s, format string
+		want      int64
+	}{
+		{"2020-09-10T21:00:00Z", "rfc3339", 1599771600000},
+		{"1599771600.123", "unix", 1599771600123},
+		{"1599771600123", "unix-ms", 1599771600123},
+		{"2020-09-10 21:00", "2006-01-02 15:04", 1599771600000},
+	} {
+		got, err := parseCSVTime(tt.s, tt.format)
+		if err != nil || got != tt.want {
+			t.Errorf("parseCSVTime(%s, %s) = %d, %v, wants %d", tt.s, tt.format, got, err, tt.want)
+		}
+	}
+}
+
+func Test_tenantWriters(t *testing.T) {
+	var relabelConfig []*relabel.Config
+	err := yaml.Unmarshal([]byte(`
+- source_labels: [__name__]
+  regex: junk
+  action: drop
+- target_label: __meta_ext_labels
+  replacement: env`), &relabelConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// results should not depend on evictions from relabel cache
+	for _, cacheSize := range []int{relabelCacheSize, 1} {
+		dir := t.TempDir()
+		w := newTenantWriters(relabelConfig, func() *blockWriters {
+			return newBlockWriters(dir, tsdb.DefaultBlockDuration, 5000, 1, log.NewNopLogger())
+		})
+		w.cacheSize = cacheSize
+		for i, l := range []string{`metric{env="a", i="1"}`, `metric{env="b", i="1"}`, `metric{env="a", i="2"}`, `junk{env="a"}`, `metric{env="a", i="1"}`, `junk{env="a"}`} {
+			lbls, err := parser.ParseMetric(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.append(context.Background(), sample{l: lbls, t: int64(i), v: 1}); err != nil {
+				t.Fatalf("append() error = %v", err)
+			}
+		}
+		if len(w.cache) > cacheSize {
+			t.Errorf("cache size = %d, wants <= %d", len(w.cache), cacheSize)
+		}
+		if w.dropped != 2 {
+			t.Errorf("dropped = %d, wants 2", w.dropped)
+		}
+		if len(w.tenants) != 2 {
+			t.Fatalf("tenants = %d, wants 2", len(w.tenants))
+		}
+		for _, tenant := range w.tenants {
+			ids, err := tenant.writers.flush(context.Background())
+			if err != nil || len(ids) != 1 {
+				t.Fatalf("flush() = %v, %v", ids, err)
+			}
+			b, err := tsdb.OpenBlock(nil, filepath.Join(dir, ids[0].String()), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wants := map[string]uint64{`{env="a"}`: 2, `{env="b"}`: 1}[tenant.extLabels.String()]
+			if got := b.Meta().Stats.NumSeries; got != wants {
+				t.Errorf("tenant %s series = %d, wants %d", tenant.extLabels, got, wants)
+			}
+			b.Close()
+		}
+		w.close()
+	}
+}
+
+// readBlockSamples returns samples of all series in block as text
+func readBlockSamples(t *testing.T, dir string, id ulid.ULID) []string {
+	b, err := tsdb.OpenBlock(nil, filepath.Join(dir, id.String()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	q, err := tsdb.NewBlockQuerier(b, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	var res []string
+	ss := q.Select(true, nil, labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"))
+	for ss.Next() {
+		it := ss.At().Iterator(nil)
+		for it.Next() == chunkenc.ValFloat {
+			ts, v := it.At()
+			res = append(res, fmt.Sprintf("%s %g %d", ss.At().Labels(), v, ts))
+		}
+	}
+	if err := ss.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func Test_blockWritersEviction(t *testing.T) {
+	// samples of each series alternate between two block time ranges
+	var samples []sample
+	for i := int64(0); i < 10; i++ {
+		for _, name := range []string{"a", "b"} {
+			l := labels.FromStrings("__name__", name)
+			samples = append(samples, sample{l: l, t: i, v: float64(i)}, sample{l: l, t: tsdb.DefaultBlockDuration + i, v: float64(-i)})
+		}
+	}
+
+	write := func(maxOpen int) ([]ulid.ULID, string) {
+		dir := t.TempDir()
+		bw := newBlockWriters(dir, tsdb.DefaultBlockDuration, 10, maxOpen, log.NewNopLogger())
+		defer bw.close()
+		for _, s := range samples {
+			if err := bw.append(context.Background(), s); err != nil {
+				t.Fatalf("append() error = %v", err)
+			}
+		}
+		ids, err := bw.flush(context.Background())
+		if err != nil {
+			t.Fatalf("flush() error = %v", err)
+		}
+		return ids, dir
+	}
+	wantIDs, wantDir := write(4)
+	gotIDs, gotDir := write(1)
+	if len(gotIDs) != 2 || len(wantIDs) != 2 {
+		t.Fatalf("flush() = %d blocks with max-open-blocks=1, %d with 4, wants 2", len(gotIDs), len(wantIDs))
+	}
+	for i := range wantIDs {
+		got, want := readBlockSamples(t, gotDir, gotIDs[i]), readBlockSamples(t, wantDir, wantIDs[i])
+		if len(want) != 20 {
+			t.Fatalf("block %d has %d samples, wants 20", i, len(want))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("block %d with max-open-blocks=1 has %d samples %q..., wants %d samples", i, len(got), got[:min(len(got), 3)], len(want))
+		}
+	}
+	if entries, err := os.ReadDir(gotDir); err != nil || len(entries) != 2 {
+		t.Errorf("partial blocks are not cleaned up: %v, %v", entries, err)
+	}
+}
+
+func Test_openInput(t *testing.T) {
+	data := "metric{label=\"value\"} 1 1000\n"
+	var gz, zs bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(data))
+	gw.Close()
+	zw, err := zstd.NewWriter(&zs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write([]byte(data))
+	zw.Close()
+
+	cases := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{name: "plain", content: []byte(data), want: data},
+		{name: "gzip", content: gz.Bytes(), want: data},
+		{name: "zstd", content: zs.Bytes(), want: data},
+		{name: "empty", content: nil, want: ""},
+	}
+	for _, td := range cases {
+		file := filepath.Join(t.TempDir(), td.name)
+		if err := os.WriteFile(file, td.content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := openInput(file)
+		if err != nil {
+			t.Fatalf("openInput(%s) error = %v", td.name, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("openInput(%s) read error = %v", td.name, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("openInput(%s) close error = %v", td.name, err)
+		}
+		if string(got) != td.want {
+			t.Errorf("openInput(%s) = %q, wants %q", td.name, got, td.want)
+		}
+	}
+}
+
+func Test_mergeSorted(t *testing.T) {
+	// each producer is sorted by time, and one of them is empty
+	inputs := [][]int64{{1, 4, 4, 9}, {}, {0, 2, 3, 10, 11}, {5}}
+	producers := make([]func(context.Context, sampleAppender) error, len(inputs))
+	for i, ts := range inputs {
+		i, ts := i, ts
+		producers[i] = func(ctx context.Context, app sampleAppender) error {
+			for _, v := range ts {
+				if err := app.append(ctx, sample{l: labels.FromStrings("p", fmt.Sprint(i)), t: v}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	var app testAppender
+	if err := mergeSorted(context.Background(), producers, &app); err != nil {
+		t.Fatalf("mergeSorted() error = %v", err)
+	}
+	var got []int64
+	for _, s := range app {
+		got = append(got, s.t)
+	}
+	if want := []int64{0, 1, 2, 3, 4, 4, 5, 9, 10, 11}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeSorted() = %v, wants %v", got, want)
+	}
+
+	producers = append(producers, func(context.Context, sampleAppender) error {
+		return fmt.Errorf("broken input")
+	})
+	if err := mergeSorted(context.Background(), producers, &testAppender{}); err == nil || err.Error() != "broken input" {
+		t.Errorf("mergeSorted() error = %v, wants producer error", err)
+	}
+}
+
+func Test_mergeInputs(t *testing.T) {
+	inputs := []string{"a 1 1000\na 6 6000\n", "# HELP b help\nb 0 0\nb 9 9000\n", "c 2 2000\nc 3 3000\n", "", "d 4 4000\nd 5 5000\n"}
+	dir := t.TempDir()
+	var files []string
+	for i, in := range inputs {
+		file := filepath.Join(dir, fmt.Sprintf("input-%d.prom", i))
+		if err := os.WriteFile(file, []byte(in), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	for _, fanIn := range []int{2, len(files)} {
+		mergeDir := filepath.Join(dir, "merge")
+		var app testAppender
+		var stats skippedEntries
+		if err := mergeInputs(context.Background(), files, inputFormat{name: "prom"}, fanIn, mergeDir, &app, &stats, log.NewNopLogger()); err != nil {
+			t.Fatalf("mergeInputs(fanIn=%d) error = %v", fanIn, err)
+		}
+		var got []string
+		for _, s := range app {
+			got = append(got, fmt.Sprintf("%s %g %d", s.l, s.v, s.t))
+		}
+		want := []string{`{__name__="b"} 0 0`, `{__name__="a"} 1 1000`, `{__name__="c"} 2 2000`, `{__name__="c"} 3 3000`, `{__name__="d"} 4 4000`, `{__name__="d"} 5 5000`, `{__name__="a"} 6 6000`, `{__name__="b"} 9 9000`}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("mergeInputs(fanIn=%d) = %q, wants %q", fanIn, got, want)
+		}
+		if stats.metadata != 1 {
+			t.Errorf("mergeInputs(fanIn=%d) metadata=%d, wants 1", fanIn, stats.metadata)
+		}
+		if _, err := os.Stat(mergeDir); !os.IsNotExist(err) {
+			t.Errorf("mergeInputs(fanIn=%d) left temporary dir %s: %v", fanIn, mergeDir, err)
+		}
+	}
+}
+
+func Test_sortInputs(t *testing.T) {
+	// grouped by series, so not sorted by time
+	input := `a 1 3000
+a 2 1000
+a 3 5000
+b 4 2000
+b 5 4000
+b 6 0
+h {type:int,schema:0,count:1,sum:1,zero_threshold:0.001,zero_count:1,positive_spans:[],positive_buckets:[],negative_spans:[],negative_buckets:[]} 2500
+`
+	dir := t.TempDir()
+	file := filepath.Join(dir, "input.prom")
+	if err := os.WriteFile(file, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sortDir := filepath.Join(dir, "sort")
+	var app testAppender
+	// buffer of 2 samples produces 4 sorted runs to merge
+	err := sortInputs(context.Background(), []string{file}, inputFormat{name: "prom"}, 2, sortDir, &app, &skippedEntries{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("sortInputs() error = %v", err)
+	}
+	var got []string
+	for _, s := range app {
+		got = append(got, fmt.Sprintf("%s %g %d", s.l, s.v, s.t))
+	}
+	want := []string{`{__name__="b"} 6 0`, `{__name__="a"} 2 1000`, `{__name__="b"} 4 2000`, `{__name__="h"} 0 2500`, `{__name__="a"} 1 3000`, `{__name__="b"} 5 4000`, `{__name__="a"} 3 5000`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortInputs() = %q, wants %q", got, want)
+	}
+	if h := app[3].h; h == nil || h.Count != 1 || h.ZeroCount != 1 {
+		t.Errorf("sortInputs() histogram = %v, wants count 1", h)
+	}
+	if _, err := os.Stat(sortDir); !os.IsNotExist(err) {
+		t.Errorf("sortInputs() left temporary dir %s: %v", sortDir, err)
+	}
+}
+
+func Test_mergeRuns(t *testing.T) {
+	dir := t.TempDir()
+	inputs := [][]int64{{1, 6}, {0, 9}, {2, 3}, {5}, {4, 7, 8}}
+	var runs []string
+	for i, ts := range inputs {
+		name := filepath.Join(dir, fmt.Sprintf("run-%06d", i))
+		err := writeRun(name, func(w sampleAppender) error {
+			for _, v := range ts {
+				if err := w.append(context.Background(), sample{l: labels.FromStrings("p", fmt.Sprint(i)), t: v, v: float64(v)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, name)
+	}
+
+	// fan-in of 2 merges 5 runs to 3, then to 2 runs before the final merge
+	var app testAppender
+	if err := mergeRuns(context.Background(), dir, runs, 2, &app, log.NewNopLogger()); err != nil {
+		t.Fatalf("mergeRuns() error = %v", err)
+	}
+	var got []int64
+	for _, s := range app {
+		if s.v != float64(s.t) {
+			t.Errorf("mergeRuns() sample %v has value %g, wants %d", s.l, s.v, s.t)
+		}
+		got = append(got, s.t)
+	}
+	if want := []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeRuns() = %v, wants %v", got, want)
+	}
+	for _, run := range runs {
+		if _, err := os.Stat(run); !os.IsNotExist(err) {
+			t.Errorf("mergeRuns() left merged run %s: %v", run, err)
+		}
+	}
+}
@@ -2,14 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"github.com/alecthomas/units"
 	"github.com/go-kit/log"
 	"github.com/oklog/ulid"
 	"github.com/olekukonko/tablewriter"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/thanos-io/objstore"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	mtd "github.com/thanos-io/thanos/pkg/model"
@@ -18,7 +21,9 @@ import (
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 	"io"
+	"math"
 	"os"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,27 +34,94 @@ import (
 const concurrency = 32
 
 var (
-	inspectColumns = []string{"DIR", "ULID", "FROM", "RANGE", "LVL", "RES", "#SAMPLES", "#CHUNKS", "LABELS", "SRC"}
+	inspectColumns = []string{"DIR", "ULID", "FROM", "RANGE", "LVL", "RES", "#SAMPLES", "#CHUNKS", "LABELS", "SRC", "MARKS"}
+	inspectOutputs = []string{"table", "json", "csv", "tsv"}
+	csvColumns     = []string{"prefix", "ulid", "min_time", "max_time", "level", "sources", "parents", "resolution", "samples", "chunks", "series", "labels", "source", "marks"}
+	groupColumns   = []string{"DIR", "LVL", "RES", "LABELS", "SRC"}
+	// inspect columns having totals in groups, so groups could be sorted by them
+	groupSortColumns = []string{"FROM", "RANGE", "#SAMPLES", "#CHUNKS"}
 )
 
 type Meta struct {
 	metadata.Meta
-	Prefix string
+	Prefix string   `json:"prefix"`
+	Marks  []string `json:"marks,omitempty"` // markers found in block dir, filled by getBlocks for recursive listing or by getAllMarks
 }
 
-func inspect(bkt objstore.Bucket, recursive *bool, selector *[]string, sortBy *[]string, maxTime *mtd.TimeOrDurationValue, logger log.Logger) error {
-	selectorLabels, err := parseFlagLabels(*selector)
+func inspect(ctx context.Context, bkt objstore.Bucket, recursive *bool, selector *[]string, sortBy *[]string, maxTime, dataMinTime, dataMaxTime *mtd.TimeOrDurationValue, output *string, groupBy *[]string, hideMarked, onlyMarked bool, logger log.Logger) error {
+	sel, err := parseSelector(*selector)
 	if err != nil {
 		return errors.Wrap(err, "error parsing selector flag")
 	}
+	groupCols, err := parseGroupBy(*groupBy)
+	if err != nil {
+		return err
+	}
+	for _, col := range *sortBy {
+		if len(groupCols) > 0 && getStrIndex(groupSortColumns, col) == -1 && getStrIndex(groupCols, col) == -1 {
+			return errors.Errorf("--sort-by %s is not available with --group-by, should be one of %s", col, strings.Join(append(append([]string{}, groupCols...), groupSortColumns...), ","))
+		}
+	}
+	if hideMarked && onlyMarked {
+		return errors.New("--hide-marked and --only-marked are mutually exclusive")
+	}
 
-	ctx := context.Background() // Ctrl-C instead of 5min limit
 	metas, err := getAllMetas(ctx, bkt, *recursive, maxTime, logger)
 	if err != nil {
 		return err
 	}
 
-	return printTable(metas, selectorLabels, *sortBy, *recursive)
+	mint, maxt, _ := dataRange(dataMinTime, dataMaxTime)
+	selected := selectMetas(metas, sel, mint, maxt)
+	// marks are not shown for groups, and recursive listing of the bucket has already found them
+	if !*recursive && (len(groupCols) == 0 || hideMarked || onlyMarked) {
+		if err := getAllMarks(ctx, bkt, selected); err != nil {
+			return err
+		}
+	}
+	if hideMarked || onlyMarked {
+		var res []*Meta
+		for _, m := range selected {
+			if (len(m.Marks) > 0) == onlyMarked {
+				res = append(res, m)
+			}
+		}
+		selected = res
+	}
+	if len(groupCols) > 0 {
+		groups := groupMetas(selected, groupCols)
+		sortGroups(groups, *sortBy)
+		switch *output {
+		case "json":
+			return printJSON(os.Stdout, groups)
+		case "csv":
+			return printGroupsCSV(os.Stdout, groups, groupCols, ',')
+		case "tsv":
+			return printGroupsCSV(os.Stdout, groups, groupCols, '\t')
+		}
+		printTable(os.Stdout, newGroupTable(groups, groupCols))
+		return nil
+	}
+
+	if len(*sortBy) == 0 {
+		*sortBy = []string{"FROM", "LABELS"}
+	}
+	t, err := newTable(selected, *sortBy, *recursive)
+	if err != nil {
+		return err
+	}
+	sort.Sort(t)
+
+	switch *output {
+	case "json":
+		return printJSON(os.Stdout, t.Metas)
+	case "csv":
+		return printCSV(os.Stdout, t.Metas, ',')
+	case "tsv":
+		return printCSV(os.Stdout, t.Metas, '\t')
+	}
+	printTable(os.Stdout, t)
+	return nil
 }
 
 func parseFlagLabels(s []string) (labels.Labels, error) {
@@ -76,6 +148,40 @@ func parseFlagLabels(s []string) (labels.Labels, error) {
 	return lset, nil
 }
 
+// Selector is parsed Thanos block labels selector flags
+type Selector struct {
+	Labels   labels.Labels     // 'key="value"' pairs, the key must be present, "*" value means any value
+	Matchers []*labels.Matcher // PromQL-style matchers, missing label is treated as label with empty value
+}
+
+// Empty checks if selector matches all blocks
+func (s Selector) Empty() bool {
+	return len(s.Labels) == 0 && len(s.Matchers) == 0
+}
+
+// parseSelector parses Thanos block labels selector flags. Each value could be either
+// PromQL-style selector like '{key1=~"value.*",key2!="value2"}' or single 'key="value"' pair,
+// where "*" value means the key should be present with any value.
+func parseSelector(s []string) (Selector, error) {
+	var sel Selector
+	for _, v := range s {
+		if strings.HasPrefix(strings.TrimSpace(v), "{") {
+			m, err := parser.ParseMetricSelector(v)
+			if err != nil {
+				return sel, errors.Wrapf(err, "parse selector %s", v)
+			}
+			sel.Matchers = append(sel.Matchers, m...)
+			continue
+		}
+		lset, err := parseFlagLabels([]string{v})
+		if err != nil {
+			return sel, err
+		}
+		sel.Labels = append(sel.Labels, lset...)
+	}
+	return sel, nil
+}
+
 // read mata.json from all blocks in bucket
 func getAllMetas(ctx context.Context, bkt objstore.Bucket, recursive bool, maxTime *mtd.TimeOrDurationValue, logger log.Logger) (map[ulid.ULID]*Meta, error) {
 	blocks, err := getBlocks(ctx, bkt, recursive, maxTime)
@@ -98,7 +204,7 @@ func getAllMetas(ctx context.Context, bkt objstore.Bucket, recursive bool, maxTi
 					return err
 				}
 				mu.Lock()
-				res[b.Id] = &Meta{Meta: *m, Prefix: b.Prefix}
+				res[b.Id] = &Meta{Meta: *m, Prefix: b.Prefix, Marks: b.Marks}
 				mu.Unlock()
 			}
 			return nil
@@ -124,15 +230,108 @@ func getAllMetas(ctx context.Context, bkt objstore.Bucket, recursive bool, maxTi
 	return res, nil
 }
 
-func printTable(blockMetas map[ulid.ULID]*Meta, selectorLabels labels.Labels, sortBy []string, recursive bool) error {
+// getAllMarks fills metas with markers (deletion, no-compact etc.) found in block dirs.
+// Only block dirs are listed, not the chunks in them
+func getAllMarks(ctx context.Context, bkt objstore.Bucket, metas []*Meta) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(concurrency)
+	for _, m := range metas {
+		m := m
+		eg.Go(func() error {
+			return bkt.Iter(ctx, m.Prefix+m.ULID.String(), func(name string) error {
+				if marker, ok := markerName(path.Base(name)); ok {
+					m.Marks = append(m.Marks, marker)
+				}
+				return nil
+			})
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return errors.Wrap(err, "get block markers")
+	}
+	for _, m := range metas {
+		sort.Strings(m.Marks)
+	}
+	return nil
+}
+
+// markerName returns name of the marker (as in --marker of mark command) stored in file
+func markerName(file string) (string, bool) {
+	for marker, f := range markers {
+		if file == f {
+			return marker, true
+		}
+	}
+	return "", false
+}
+
+// dataRange returns data time range flags as timestamps, and whether any of them is set.
+// Flags have no defaults, so unset ones mean unbounded range
+func dataRange(minTime, maxTime *mtd.TimeOrDurationValue) (mint, maxt int64, set bool) {
+	mint, maxt = math.MinInt64, math.MaxInt64
+	if minTime.Time != nil || minTime.Dur != nil {
+		mint, set = minTime.PrometheusTimestamp(), true
+	}
+	if maxTime.Time != nil || maxTime.Dur != nil {
+		maxt, set = maxTime.PrometheusTimestamp(), true
+	}
+	return mint, maxt, set
+}
+
+// selectMetas returns metas matching selector and having data in [mint, maxt) time range, sorted by block path
+func selectMetas(metas map[ulid.ULID]*Meta, sel Selector, mint, maxt int64) []*Meta {
+	var res []*Meta
+	for _, m := range metas {
+		// block time range is [MinTime, MaxTime)
+		if m.MinTime < maxt && m.MaxTime > mint && matchesSelector(m, sel) {
+			res = append(res, m)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Prefix+res[i].ULID.String() < res[j].Prefix+res[j].ULID.String()
+	})
+	return res
+}
+
+// filterIDs returns only metas with ULIDs from ids, or all metas when ids are empty
+func filterIDs(metas []*Meta, ids []string) []*Meta {
+	if len(ids) == 0 {
+		return metas
+	}
+	var res []*Meta
+	for _, m := range metas {
+		if getStrIndex(ids, m.ULID.String()) != -1 {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// missingIDs returns requested ids not found in metas
+func missingIDs(metas []*Meta, ids []string) []string {
+	var res []string
+	for _, id := range ids {
+		found := false
+		for _, m := range metas {
+			if m.ULID.String() == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// newTable returns humanized table lines for blocks, along with their metas
+func newTable(blockMetas []*Meta, sortBy []string, recursive bool) (Table, error) {
 	var lines [][]string
+	var metas []*Meta
 	p := message.NewPrinter(language.English)
 
 	for _, blockMeta := range blockMetas {
-		if !matchesSelector(blockMeta, selectorLabels) {
-			continue
-		}
-
 		timeRange := time.Duration((blockMeta.MaxTime - blockMeta.MinTime) * int64(time.Millisecond))
 
 		var line []string
@@ -148,45 +347,277 @@ func printTable(blockMetas map[ulid.ULID]*Meta, selectorLabels labels.Labels, so
 		line = append(line, p.Sprintf("%d", blockMeta.Stats.NumChunks))
 		line = append(line, labelsToString(blockMeta.Thanos.Labels))
 		line = append(line, string(blockMeta.Thanos.Source))
+		line = append(line, strings.Join(blockMeta.Marks, ","))
 		lines = append(lines, line)
+		metas = append(metas, blockMeta)
 	}
 
+	header := inspectColumns
 	if !recursive {
-		inspectColumns = inspectColumns[1:]
+		header = header[1:]
 	}
 	var sortByColNum []int
 	for _, col := range sortBy {
-		index := getStrIndex(inspectColumns, col)
+		index := getStrIndex(header, col)
 		if index == -1 {
-			return errors.Errorf("column %s not found", col)
+			return Table{}, errors.Errorf("column %s not found", col)
 		}
 		sortByColNum = append(sortByColNum, index)
 	}
 
-	t := Table{Header: inspectColumns, Lines: lines, SortIndices: sortByColNum}
-	sort.Sort(t)
+	return Table{Header: header, Lines: lines, SortIndices: sortByColNum, Metas: metas}, nil
+}
 
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader(inspectColumns)
+func printTable(w io.Writer, t Table) {
+	table := tablewriter.NewWriter(w)
+	table.SetHeader(t.Header)
 	table.SetBorders(tablewriter.Border{Left: false, Top: false, Right: false, Bottom: false})
 	table.SetCenterSeparator("|")
 	table.SetAutoWrapText(false)
 	table.SetReflowDuringAutoWrap(false)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
-	table.AppendBulk(lines)
+	table.AppendBulk(t.Lines)
 	table.Render()
+}
 
-	return nil
+// printJSON writes items as json array with raw (not humanized) values
+func printJSON[T any](w io.Writer, items []T) error {
+	if items == nil {
+		items = []T{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(items)
+}
+
+// printCSV writes metas as delimiter separated values with raw (not humanized) values
+func printCSV(w io.Writer, metas []*Meta, delimiter rune) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = delimiter
+	if err := cw.Write(csvColumns); err != nil {
+		return err
+	}
+	for _, m := range metas {
+		var sources, parents []string
+		for _, id := range m.Compaction.Sources {
+			sources = append(sources, id.String())
+		}
+		for _, b := range m.Compaction.Parents {
+			parents = append(parents, b.ULID.String())
+		}
+		err := cw.Write([]string{
+			m.Prefix,
+			m.ULID.String(),
+			strconv.FormatInt(m.MinTime, 10),
+			strconv.FormatInt(m.MaxTime, 10),
+			strconv.Itoa(m.Compaction.Level),
+			strings.Join(sources, " "),
+			strings.Join(parents, " "),
+			strconv.FormatInt(m.Thanos.Downsample.Resolution, 10),
+			strconv.FormatUint(m.Stats.NumSamples, 10),
+			strconv.FormatUint(m.Stats.NumChunks, 10),
+			strconv.FormatUint(m.Stats.NumSeries, 10),
+			labelsToString(m.Thanos.Labels),
+			string(m.Thanos.Source),
+			strings.Join(m.Marks, ","),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Group is an aggregation of blocks having the same values of group-by columns
+type Group struct {
+	By         map[string]string `json:"by"` // raw values of group-by columns
+	Blocks     int               `json:"blocks"`
+	MinTime    int64             `json:"minTime"`
+	MaxTime    int64             `json:"maxTime"`
+	NumSamples uint64            `json:"numSamples"`
+	NumChunks  uint64            `json:"numChunks"`
+	NumSeries  uint64            `json:"numSeries"`
+	SizeBytes  int64             `json:"sizeBytes"` // sum of meta.json files stats
+}
+
+// parseGroupBy validates group-by columns, which could be comma separated or repeated
+func parseGroupBy(s []string) ([]string, error) {
+	var res []string
+	for _, v := range s {
+		for _, col := range strings.Split(v, ",") {
+			col = strings.ToUpper(strings.TrimSpace(col))
+			if getStrIndex(groupColumns, col) == -1 {
+				return nil, errors.Errorf("unsupported group-by column %s, should be one of %s", col, strings.Join(groupColumns, ","))
+			}
+			if getStrIndex(res, col) == -1 {
+				res = append(res, col)
+			}
+		}
+	}
+	return res, nil
+}
+
+// groupValue returns raw value of group-by column for the block
+func groupValue(m *Meta, col string) string {
+	switch col {
+	case "DIR":
+		return m.Prefix
+	case "LVL":
+		return strconv.Itoa(m.Compaction.Level)
+	case "RES":
+		return strconv.FormatInt(m.Thanos.Downsample.Resolution, 10)
+	case "LABELS":
+		return labelsToString(m.Thanos.Labels)
+	case "SRC":
+		return string(m.Thanos.Source)
+	}
+	return ""
+}
+
+// groupMetas aggregates metas to groups by columns, sorted by columns values
+func groupMetas(metas []*Meta, cols []string) []*Group {
+	var groups []*Group
+	index := map[string]*Group{}
+	for _, m := range metas {
+		values := make([]string, len(cols))
+		for i, col := range cols {
+			values[i] = groupValue(m, col)
+		}
+		key := strings.Join(values, "\xff")
+		g, ok := index[key]
+		if !ok {
+			g = &Group{By: map[string]string{}, MinTime: m.MinTime, MaxTime: m.MaxTime}
+			for i, col := range cols {
+				g.By[col] = values[i]
+			}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.Blocks++
+		g.MinTime = min(g.MinTime, m.MinTime)
+		g.MaxTime = max(g.MaxTime, m.MaxTime)
+		g.NumSamples += m.Stats.NumSamples
+		g.NumChunks += m.Stats.NumChunks
+		g.NumSeries += m.Stats.NumSeries
+		for _, f := range m.Thanos.Files {
+			g.SizeBytes += f.SizeBytes
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		for _, col := range cols {
+			if groups[i].By[col] != groups[j].By[col] {
+				return compare(groups[i].By[col], groups[j].By[col])
+			}
+		}
+		return false
+	})
+	return groups
+}
+
+// sortGroups sorts groups by inspect columns, which are either group-by columns or totals.
+// Groups are left sorted by group-by columns when sortBy is empty
+func sortGroups(groups []*Group, sortBy []string) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		for _, col := range sortBy {
+			v1, v2 := groups[i].sortValue(col), groups[j].sortValue(col)
+			if v1 != v2 {
+				return compare(v1, v2)
+			}
+		}
+		return false
+	})
+}
+
+// sortValue returns raw value of the column for sorting
+func (g *Group) sortValue(col string) string {
+	switch col {
+	case "FROM":
+		return strconv.FormatInt(g.MinTime, 10)
+	case "RANGE":
+		return strconv.FormatInt(g.MaxTime-g.MinTime, 10)
+	case "#SAMPLES":
+		return strconv.FormatUint(g.NumSamples, 10)
+	case "#CHUNKS":
+		return strconv.FormatUint(g.NumChunks, 10)
+	}
+	return g.By[col]
+}
+
+// newGroupTable returns humanized table lines for groups
+func newGroupTable(groups []*Group, cols []string) Table {
+	var lines [][]string
+	p := message.NewPrinter(language.English)
+	for _, g := range groups {
+		var line []string
+		for _, col := range cols {
+			v := g.By[col]
+			if col == "RES" {
+				res, _ := strconv.ParseInt(v, 10, 64)
+				v = humanizeDuration(time.Duration(res * int64(time.Millisecond)))
+			}
+			line = append(line, v)
+		}
+		line = append(line, p.Sprintf("%d", g.Blocks))
+		line = append(line, time.Unix(g.MinTime/1000, 0).Format("2006-01-02 15:04:05"))
+		line = append(line, time.Unix(g.MaxTime/1000, 0).Format("2006-01-02 15:04:05"))
+		line = append(line, p.Sprintf("%d", g.NumSamples))
+		line = append(line, p.Sprintf("%d", g.NumChunks))
+		line = append(line, p.Sprintf("%d", g.NumSeries))
+		line = append(line, units.Base2Bytes(g.SizeBytes).String())
+		lines = append(lines, line)
+	}
+	header := append(append([]string{}, cols...), "#BLOCKS", "FROM", "TO", "#SAMPLES", "#CHUNKS", "#SERIES", "SIZE")
+	return Table{Header: header, Lines: lines}
+}
+
+// printGroupsCSV writes groups as delimiter separated values with raw (not humanized) values
+func printGroupsCSV(w io.Writer, groups []*Group, cols []string, delimiter rune) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = delimiter
+	var header []string
+	for _, col := range cols {
+		header = append(header, strings.ToLower(col))
+	}
+	header = append(header, "blocks", "min_time", "max_time", "samples", "chunks", "series", "size_bytes")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		var line []string
+		for _, col := range cols {
+			line = append(line, g.By[col])
+		}
+		line = append(line,
+			strconv.Itoa(g.Blocks),
+			strconv.FormatInt(g.MinTime, 10),
+			strconv.FormatInt(g.MaxTime, 10),
+			strconv.FormatUint(g.NumSamples, 10),
+			strconv.FormatUint(g.NumChunks, 10),
+			strconv.FormatUint(g.NumSeries, 10),
+			strconv.FormatInt(g.SizeBytes, 10),
+		)
+		if err := cw.Write(line); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
 }
 
 // matchesSelector checks if blockMeta contains every label from
-// the selector with the correct value.
-func matchesSelector(blockMeta *Meta, selectorLabels labels.Labels) bool {
-	for _, l := range selectorLabels {
+// the selector with the correct value, and matches all the matchers.
+func matchesSelector(blockMeta *Meta, sel Selector) bool {
+	for _, l := range sel.Labels {
 		if v, ok := blockMeta.Thanos.Labels[l.Name]; !ok || (l.Value != "*" && v != l.Value) {
 			return false
 		}
 	}
+	for _, m := range sel.Matchers {
+		if !m.Matches(blockMeta.Thanos.Labels[m.Name]) {
+			return false
+		}
+	}
 	return true
 }
 
@@ -243,11 +674,17 @@ type Table struct {
 	Header      []string
 	Lines       [][]string
 	SortIndices []int
+	Metas       []*Meta // optional, sorted along with Lines
 }
 
 func (t Table) Len() int { return len(t.Lines) }
 
-func (t Table) Swap(i, j int) { t.Lines[i], t.Lines[j] = t.Lines[j], t.Lines[i] }
+func (t Table) Swap(i, j int) {
+	t.Lines[i], t.Lines[j] = t.Lines[j], t.Lines[i]
+	if t.Metas != nil {
+		t.Metas[i], t.Metas[j] = t.Metas[j], t.Metas[i]
+	}
+}
 
 func (t Table) Less(i, j int) bool {
 	for _, index := range t.SortIndices {
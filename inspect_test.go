@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/oklog/ulid"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
 )
 
 func Test_parseFlagLabels(t *testing.T) {
@@ -48,12 +55,13 @@ func Test_matchesSelector(t *testing.T) {
 	cases := []struct {
 		thanosLabels   map[string]string
 		selectorLabels labels.Labels
+		selector       []string
 		res            bool
 	}{
 		{
 			thanosLabels: map[string]string{"label": "value"},
 			selectorLabels: labels.Labels{
-				{"label", "value"},
+				{Name: "label", Value: "value"},
 			},
 			res: true,
 		},
@@ -64,8 +72,8 @@ func Test_matchesSelector(t *testing.T) {
 				"label3 ": "value3 ",
 			},
 			selectorLabels: labels.Labels{
-				{"label", "*"},
-				{"label3 ", "value3 "},
+				{Name: "label", Value: "*"},
+				{Name: "label3 ", Value: "value3 "},
 			},
 			res: true,
 		},
@@ -75,18 +83,218 @@ func Test_matchesSelector(t *testing.T) {
 				"label2": "value2",
 			},
 			selectorLabels: labels.Labels{
-				{"label", "value"},
-				{"label3 ", "value3 "},
+				{Name: "label", Value: "value"},
+				{Name: "label3 ", Value: "value3 "},
 			},
 			res: false,
 		},
+		{
+			thanosLabels: map[string]string{"label": "value"},
+			selector:     []string{`label2="*"`},
+			res:          false,
+		},
+		{
+			thanosLabels: map[string]string{"label": "value"},
+			selector:     []string{`label2=""`},
+			res:          false,
+		},
+		{
+			thanosLabels: map[string]string{"label": "value"},
+			selector:     []string{`{label2=""}`},
+			res:          true,
+		},
+		{
+			thanosLabels: map[string]string{"cluster": "prod-eu", "replica": "a"},
+			selector:     []string{`{cluster=~"prod-.*",replica!="b"}`},
+			res:          true,
+		},
+		{
+			thanosLabels: map[string]string{"cluster": "prod-eu", "replica": "b"},
+			selector:     []string{`{cluster=~"prod-.*",replica!="b"}`},
+			res:          false,
+		},
+		{
+			thanosLabels: map[string]string{"cluster": "dev", "replica": "a"},
+			selector:     []string{`{cluster!~"prod-.*"}`, `replica="a"`},
+			res:          true,
+		},
 	}
 	for _, td := range cases {
+		sel, err := parseSelector(td.selector)
+		if err != nil {
+			t.Fatalf("parseSelector(%q): %v", td.selector, err)
+		}
+		sel.Labels = append(sel.Labels, td.selectorLabels...)
 		blockMeta := Meta{}
 		blockMeta.Thanos.Labels = td.thanosLabels
-		res := matchesSelector(&blockMeta, td.selectorLabels)
+		res := matchesSelector(&blockMeta, sel)
 		if res != td.res {
-			t.Errorf("matchesSelector(%q, %q)=%v, wants %v", td.thanosLabels, td.selectorLabels, res, td.res)
+			t.Errorf("matchesSelector(%q, %q %q)=%v, wants %v", td.thanosLabels, td.selectorLabels, td.selector, res, td.res)
+		}
+	}
+}
+
+func Test_printCSV(t *testing.T) {
+	m := &Meta{Prefix: "tenant/"}
+	m.ULID = ulid.MustParse("01GXGKXC3PA1DE6QNAH2BM2P0R")
+	m.MinTime = 1599771600000
+	m.MaxTime = 1599778800000
+	m.Compaction.Level = 2
+	m.Compaction.Sources = []ulid.ULID{ulid.MustParse("01GXGKXC3PA1DE6QNAH2BM2P0A"), ulid.MustParse("01GXGKXC3PA1DE6QNAH2BM2P0B")}
+	m.Thanos.Downsample.Resolution = 300000
+	m.Stats.NumSamples = 1234567
+	m.Thanos.Labels = map[string]string{"b": "2", "a": "1"}
+	m.Thanos.Source = "compactor"
+	m.Marks = []string{"deletion", "no-compact"}
+
+	var buf bytes.Buffer
+	if err := printCSV(&buf, []*Meta{m}, '\t'); err != nil {
+		t.Fatal(err)
+	}
+	exp := "prefix\tulid\tmin_time\tmax_time\tlevel\tsources\tparents\tresolution\tsamples\tchunks\tseries\tlabels\tsource\tmarks\n" +
+		"tenant/\t01GXGKXC3PA1DE6QNAH2BM2P0R\t1599771600000\t1599778800000\t2\t01GXGKXC3PA1DE6QNAH2BM2P0A 01GXGKXC3PA1DE6QNAH2BM2P0B\t\t300000\t1234567\t0\t0\ta=1, b=2\tcompactor\tdeletion,no-compact\n"
+	if buf.String() != exp {
+		t.Errorf("printCSV()=%q, wants %q", buf.String(), exp)
+	}
+}
+
+func Test_selectMetas(t *testing.T) {
+	metas := map[ulid.ULID]*Meta{}
+	for i, r := range [][2]int64{{0, 100}, {100, 200}, {200, 300}} {
+		m := &Meta{}
+		m.ULID = ulid.MustNew(uint64(i), nil)
+		m.MinTime, m.MaxTime = r[0], r[1]
+		metas[m.ULID] = m
+	}
+	cases := []struct {
+		mint, maxt int64
+		res        int
+	}{
+		{mint: 0, maxt: 300, res: 3},
+		{mint: 100, maxt: 200, res: 1},
+		{mint: 99, maxt: 101, res: 2},
+		{mint: 300, maxt: 400, res: 0},
+	}
+	for _, td := range cases {
+		res := selectMetas(metas, Selector{}, td.mint, td.maxt)
+		if len(res) != td.res {
+			t.Errorf("selectMetas(%d, %d)=%d blocks, wants %d", td.mint, td.maxt, len(res), td.res)
+		}
+	}
+}
+
+func Test_groupMetas(t *testing.T) {
+	var metas []*Meta
+	for i, res := range []int64{0, 300000, 0} {
+		m := &Meta{}
+		m.ULID = ulid.MustNew(uint64(i), nil)
+		m.MinTime, m.MaxTime = int64(i)*100, int64(i+1)*100
+		m.Stats.NumSamples = 10
+		m.Thanos.Labels = map[string]string{"p": "a"}
+		m.Thanos.Downsample.Resolution = res
+		m.Thanos.Files = []metadata.File{{RelPath: "index", SizeBytes: 5}}
+		metas = append(metas, m)
+	}
+	cols, err := parseGroupBy([]string{"labels,RES"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := groupMetas(metas, cols)
+	if len(groups) != 2 {
+		t.Fatalf("groupMetas()=%d groups, wants 2", len(groups))
+	}
+	g := groups[0]
+	if g.By["RES"] != "0" || g.Blocks != 2 || g.MinTime != 0 || g.MaxTime != 300 || g.NumSamples != 20 || g.SizeBytes != 10 {
+		t.Errorf("groupMetas()[0]=%+v", g)
+	}
+	sortGroups(groups, []string{"#SAMPLES"})
+	if groups[0].By["RES"] != "300000" {
+		t.Errorf("sortGroups(#SAMPLES)[0]=%+v, wants RES=300000", groups[0])
+	}
+	sortGroups(groups, []string{"FROM"})
+	if groups[0].By["RES"] != "0" {
+		t.Errorf("sortGroups(FROM)[0]=%+v, wants RES=0", groups[0])
+	}
+	if _, err := parseGroupBy([]string{"ULID"}); err == nil {
+		t.Errorf("parseGroupBy(ULID) should fail")
+	}
+}
+
+// iterCountingBucket counts Iter calls, and the recursive ones
+type iterCountingBucket struct {
+	objstore.Bucket
+	iters, recursiveIters int
+}
+
+func (b *iterCountingBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	b.iters++
+	if objstore.ApplyIterOptions(options...).Recursive {
+		b.recursiveIters++
+	}
+	return b.Bucket.Iter(ctx, dir, f, options...)
+}
+
+// uploadTestMarks uploads blocks with chunks to bkt, and markers to some of them. Returns metas and wanted markers
+func uploadTestMarks(t *testing.T, bkt objstore.Bucket) ([]*Meta, [][]string) {
+	var metas []*Meta
+	for i, prefix := range []string{"", "", "tenant/", "tenant/"} {
+		id := ulid.MustNew(uint64(i), nil)
+		m := uploadTestMeta(t, bkt, prefix, id, nil)
+		metas = append(metas, &Meta{Meta: *m, Prefix: prefix})
+		if err := bkt.Upload(context.Background(), prefix+id.String()+"/chunks/000001", strings.NewReader("chunks")); err != nil {
+			t.Fatal(err)
 		}
 	}
+	marks := []string{
+		metas[0].ULID.String() + "/" + metadata.DeletionMarkFilename,
+		metas[0].ULID.String() + "/" + metadata.NoCompactMarkFilename,
+		"tenant/" + metas[3].ULID.String() + "/" + metadata.NoCompactMarkFilename,
+	}
+	for _, name := range marks {
+		if err := bkt.Upload(context.Background(), name, strings.NewReader("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return metas, [][]string{{"deletion", "no-compact"}, nil, nil, {"no-compact"}}
+}
+
+func Test_getAllMarks(t *testing.T) {
+	bkt := &iterCountingBucket{Bucket: objstore.NewInMemBucket()}
+	metas, want := uploadTestMarks(t, bkt)
+	bkt.iters = 0
+	if err := getAllMarks(context.Background(), bkt, metas); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range metas {
+		if !reflect.DeepEqual(m.Marks, want[i]) {
+			t.Errorf("getAllMarks()[%d]=%q, wants %q", i, m.Marks, want[i])
+		}
+	}
+	// chunks are not listed
+	if bkt.iters != len(metas) || bkt.recursiveIters != 0 {
+		t.Errorf("getAllMarks() listed bucket %d times, %d of them recursively, wants %d non-recursive", bkt.iters, bkt.recursiveIters, len(metas))
+	}
+}
+
+func Test_getBlocksMarks(t *testing.T) {
+	bkt := &iterCountingBucket{Bucket: objstore.NewInMemBucket()}
+	metas, want := uploadTestMarks(t, bkt)
+	bkt.iters = 0
+	blocks, err := getBlocks(context.Background(), bkt, true, testTime(t, "9999-12-31T23:59:59Z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != len(metas) {
+		t.Fatalf("getBlocks()=%v, wants %d blocks", blocks, len(metas))
+	}
+	for i, m := range metas {
+		for _, b := range blocks {
+			if b.Id == m.ULID && !reflect.DeepEqual(b.Marks, want[i]) {
+				t.Errorf("getBlocks() %s marks=%q, wants %q", b.Id, b.Marks, want[i])
+			}
+		}
+	}
+	if bkt.iters != 1 {
+		t.Errorf("getBlocks() listed bucket %d times, wants 1", bkt.iters)
+	}
 }
@@ -3,36 +3,90 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/go-kit/log"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
 	"github.com/thanos-io/objstore"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/model"
+	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
-func ls(bkt objstore.Bucket, recursive *bool, maxTime *model.TimeOrDurationValue) error {
-	blocks, err := getBlocks(context.Background(), bkt, *recursive, maxTime)
-	if err == nil {
-		for _, b := range blocks {
-			fmt.Println(b.Prefix+b.Id.String(), ulid.Time(b.Id.Time()).UTC().Format("06-01-02T15:04:05Z"))
+const lsTimeFormat = "06-01-02T15:04:05Z"
+
+func ls(ctx context.Context, bkt objstore.Bucket, recursive *bool, selector *[]string, maxTime, dataMinTime, dataMaxTime *model.TimeOrDurationValue, output *string, logger log.Logger) error {
+	sel, err := parseSelector(*selector)
+	if err != nil {
+		return errors.Wrap(err, "error parsing selector flag")
+	}
+	mint, maxt, rangeSet := dataRange(dataMinTime, dataMaxTime)
+	if *output == "text" && sel.Empty() && !rangeSet {
+		// no filters, so no need to read meta.json
+		blocks, err := getBlocks(ctx, bkt, *recursive, maxTime)
+		if err == nil {
+			for _, b := range blocks {
+				fmt.Println(b.Prefix+b.Id.String(), ulid.Time(b.Id.Time()).UTC().Format(lsTimeFormat))
+			}
+		}
+		return err
+	}
+
+	all, err := getAllMetas(ctx, bkt, *recursive, maxTime, logger)
+	if err != nil {
+		return err
+	}
+	metas := selectMetas(all, sel, mint, maxt)
+
+	switch *output {
+	case "json":
+		return printJSON(os.Stdout, metas)
+	case "wide":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "BLOCK\tULID TIME\tMIN TIME\tMAX TIME\tLVL\tRES\tLABELS")
+		for _, m := range metas {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+				m.Prefix+m.ULID.String(),
+				ulid.Time(m.ULID.Time()).UTC().Format(lsTimeFormat),
+				time.UnixMilli(m.MinTime).UTC().Format(lsTimeFormat),
+				time.UnixMilli(m.MaxTime).UTC().Format(lsTimeFormat),
+				m.Compaction.Level,
+				humanizeDuration(time.Duration(m.Thanos.Downsample.Resolution)*time.Millisecond),
+				labelsToString(m.Thanos.Labels),
+			)
 		}
+		return tw.Flush()
+	}
+	for _, m := range metas {
+		fmt.Println(m.Prefix+m.ULID.String(), ulid.Time(m.ULID.Time()).UTC().Format(lsTimeFormat))
 	}
-	return err
+	return nil
 }
 
 type Block struct {
 	Prefix string
 	Id     ulid.ULID
+	Marks  []string // markers found in block dir, only for recursive listing
 }
 
 func getBlocks(ctx context.Context, bkt objstore.Bucket, recursive bool, maxTime *model.TimeOrDurationValue) (found []Block, err error) {
 	if recursive {
+		// the whole bucket is listed anyway, so collect block markers too
+		marks := map[string][]string{}
 		err = bkt.Iter(ctx, "", func(name string) error {
 			parts := strings.Split(name, "/")
 			if len(parts) < 2 {
 				return nil
 			}
 			dir, file := parts[len(parts)-2], parts[len(parts)-1]
+			if marker, ok := markerName(file); ok {
+				bdir := strings.Join(parts[:len(parts)-1], "/")
+				marks[bdir] = append(marks[bdir], marker)
+				return nil
+			}
 			if !block.IsBlockMetaFile(file) {
 				return nil
 			}
@@ -47,6 +101,10 @@ func getBlocks(ctx context.Context, bkt objstore.Bucket, recursive bool, maxTime
 			}
 			return nil
 		}, objstore.WithRecursiveIter)
+		for i, b := range found {
+			found[i].Marks = marks[b.Prefix+b.Id.String()]
+			sort.Strings(found[i].Marks)
+		}
 	} else {
 		err = bkt.Iter(ctx, "", func(name string) error {
 			if id, ok := block.IsBlockDir(name); ok && id.Time() < uint64(maxTime.PrometheusTimestamp()) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/efficientgo/tools/extkingpin"
 	"github.com/go-kit/log"
@@ -11,8 +12,11 @@ import (
 	"gopkg.in/alecthomas/kingpin.v2"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 )
 
 func main() {
@@ -23,16 +27,48 @@ func main() {
 
 	lsCmd := app.Command("ls", "List all blocks in the bucket.")
 	lsRecursive := lsCmd.Flag("recursive", "Recurive search for blocks in the  bucket (Mimir has blocks nested to tenants folders)").Short('r').Default("false").Bool()
-	lsMaxTime := model.TimeOrDuration(lsCmd.Flag("max-time", "End of time range limit to get blocks. List only those, which happened earlier than this value. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
-		Default("9999-12-31T23:59:59Z"))
+	lsSelector, lsMaxTime, lsDataMinTime, lsDataMaxTime := blockFilterFlags(lsCmd, "List")
+	lsOutput := lsCmd.Flag("output", "Output format. 'wide' and 'json' also read meta.json of each block to show data time range, compaction level, resolution and Thanos labels").Short('o').Default("text").Enum("text", "wide", "json")
 
 	inspectCmd := app.Command("inspect", "Inspect all blocks in the bucket in detailed, table-like way")
 	inspectRecursive := inspectCmd.Flag("recursive", "Recursive search for blocks in the bucket (Mimir has blocks nested to tenants folders)").Short('r').Default("false").Bool()
-	inspectSelector := inspectCmd.Flag("label", `Filter by Thanos block label, e.g. '-l key1="value1" -l key2="value2"'. All key value pairs must match. To select all blocks for some key use "*" as value.`).Short('l').PlaceHolder(`<name>="<value>"`).Strings()
-	inspectSortBy := inspectCmd.Flag("sort-by", "Sort by columns. It's also possible to sort by multiple columns, e.g. '--sort-by FROM --sort-by LABELS'. I.e., if the 'FROM' value is equal the rows are then further sorted by the 'LABELS' value").
-		Default("FROM", "LABELS").Enums(inspectColumns...)
-	inspectMaxTime := model.TimeOrDuration(inspectCmd.Flag("max-time", "End of time range limit to get blocks. Inspect only those, which happened earlier than this value. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
-		Default("9999-12-31T23:59:59Z"))
+	inspectSelector, inspectMaxTime, inspectDataMinTime, inspectDataMaxTime := blockFilterFlags(inspectCmd, "Inspect")
+	inspectSortBy := inspectCmd.Flag("sort-by", "Sort by columns. It's also possible to sort by multiple columns, e.g. '--sort-by FROM --sort-by LABELS'. I.e., if the 'FROM' value is equal the rows are then further sorted by the 'LABELS' value. Default is 'FROM', 'LABELS', or --group-by columns for groups").
+		Enums(inspectColumns...)
+	inspectOutput := inspectCmd.Flag("output", "Output format. Formats other than 'table' print raw (not humanized) values of the whole meta.json").Short('o').Default("table").Enum(inspectOutputs...)
+	inspectHideMarked := inspectCmd.Flag("hide-marked", "Hide blocks having deletion, no-compact or no-downsample markers").Default("false").Bool()
+	inspectOnlyMarked := inspectCmd.Flag("only-marked", "Show only blocks having deletion, no-compact or no-downsample markers").Default("false").Bool()
+	inspectGroupBy := inspectCmd.Flag("group-by", fmt.Sprintf("Show totals per group of blocks instead of each block, e.g. '--group-by LABELS,RES'. Columns: %s", strings.Join(groupColumns, ", "))).PlaceHolder("<columns>").Strings()
+
+	overlapsCmd := app.Command("overlaps", "Check for overlaps and gaps in time ranges of blocks with the same Thanos labels and resolution. Exit code is non-zero when issues are found")
+	overlapsRecursive := overlapsCmd.Flag("recursive", "Recursive search for blocks in the bucket (Mimir has blocks nested to tenants folders)").Short('r').Default("false").Bool()
+	overlapsSelector, overlapsMaxTime, overlapsDataMinTime, overlapsDataMaxTime := blockFilterFlags(overlapsCmd, "Check")
+	overlapsMaxGap := overlapsCmd.Flag("max-gap", "Report gaps between blocks longer than this value. 0 disables gaps check").Default("2h").Duration()
+
+	verifyCmd := app.Command("verify", "Download blocks and verify index, chunks and meta.json stats. Exit code is non-zero when issues are found")
+	verifyULIDs := verifyCmd.Arg("ULID", "Blocks id (ULID) to verify (repeated). Empty means all blocks matching filters").Strings()
+	verifyRecursive := verifyCmd.Flag("recursive", "Recursive search for blocks in the bucket (Mimir has blocks nested to tenants folders)").Short('r').Default("false").Bool()
+	verifySelector, verifyMaxTime, verifyDataMinTime, verifyDataMaxTime := blockFilterFlags(verifyCmd, "Verify")
+	verifyDir := verifyCmd.Flag("data-dir", "Data directory in which to download blocks. Each block is removed after verification").Default("./data").String()
+	verifyMark := verifyCmd.Flag("mark-no-compact", "Mark broken blocks for no-compact").Default("false").Bool()
+
+	markCmd := app.Command("mark", "Mark blocks for deletion, no-compact or no-downsample")
+	markULIDs := markCmd.Arg("ULID", "Blocks id (ULID) to mark (repeated). Empty means all blocks matching filters").Strings()
+	markMarker := markCmd.Flag("marker", "Marker to create (or remove)").Short('m').Required().Enum("deletion", "no-compact", "no-downsample")
+	markDetails := markCmd.Flag("details", "Human readable details to put into the marker").Default("").String()
+	markReason := markCmd.Flag("reason", "Reason for no-compact and no-downsample markers").Default("manual").String()
+	markRemove := markCmd.Flag("remove", "Remove the marker instead of creating it").Default("false").Bool()
+	markDry := markCmd.Flag("dry-run", "Don't do any changes to bucket. Only print what would be done.").Default("false").Bool()
+	markRecursive := markCmd.Flag("recursive", "Recursive search for blocks in the bucket (Mimir has blocks nested to tenants folders)").Short('r').Default("false").Bool()
+	markSelector, markMaxTime, markDataMinTime, markDataMaxTime := blockFilterFlags(markCmd, "Mark")
+
+	copyCmd := app.Command("copy", "Copy blocks to another bucket")
+	copyULIDs := copyCmd.Arg("ULID", "Blocks id (ULID) to copy (repeated). Empty means all blocks matching filters").Strings()
+	copyRecursive := copyCmd.Flag("recursive", "Recursive search for blocks in the bucket (Mimir has blocks nested to tenants folders)").Short('r').Default("false").Bool()
+	copySelector, copyMaxTime, copyDataMinTime, copyDataMaxTime := blockFilterFlags(copyCmd, "Copy")
+	copyDst := extkingpin.RegisterPathOrContent(copyCmd, "dst.config", "YAML file that contains destination object store configuration.", extkingpin.WithEnvSubstitution(), extkingpin.WithRequired())
+	copyPrefixMap := copyCmd.Flag("prefix-map", "Change blocks dir prefix in destination (repeated), e.g. 'tenant1=' moves Mimir tenant blocks to the bucket root. Not mapped prefixes are preserved").PlaceHolder("<src>=<dst>").Strings()
+	copyDry := copyCmd.Flag("dry-run", "Don't do any changes to bucket. Only print what would be done.").Default("false").Bool()
 
 	analyzeCmd := app.Command("analyze", "Analyze churn, label pair cardinality and find labels to split on")
 	analyzeULID := analyzeCmd.Arg("ULID", "Block id to analyze (ULID)").Required().String()
@@ -49,24 +85,39 @@ func main() {
 	dumpMatch := dumpCmd.Flag("match", "Series selector.").Default("{__name__=~'(?s:.*)'}").String()
 
 	importCmd := app.Command("import", "Import samples from text to TSDB blocks")
-	importFromFile := importCmd.Flag("input-file", "Promtext file to read samples from.").Short('f').Required().String()
+	importFromFile := importCmd.Flag("input-file", "File to read samples from, '-' for stdin. Could be repeated, glob or a directory of files, samples of all files are merged by timestamp. Compressed input (gzip, zstd) is detected automatically.").Short('f').Required().Strings()
+	importFormat := importCmd.Flag("input-format", "Format of the input file: Prometheus text format, OpenMetrics (with '# EOF') or remote-write (uvarint length-delimited snappy WriteRequests) or csv (with header, see --csv-* flags). Exemplars and metadata are skipped").Default("prom").Enum("prom", "openmetrics", "remote-write", "csv")
 	importBlockSize := importCmd.Flag("block-size", "The maximum block size. The actual block timestamps will be aligned with Prometheus time ranges").Default("2h").Duration()
 	importDir := importCmd.Flag("data-dir", "Data directory in which to cache blocks").
 		Default("./data").String()
 	importLabels := importCmd.Flag("label", "Labels to add as Thanos block metadata (repeated)").Short('l').PlaceHolder(`<name>="<value>"`).Required().Strings()
 	importUpload := importCmd.Flag("upload", "Upload imported blocks to object storage").Default("false").Bool()
+	importMaxOpen := importCmd.Flag("max-open-blocks", "Maximum number of blocks being written at the same time. Each one keeps samples in memory, when exceeded the least recently used one is flushed to disk and compacted with the rest of its time range at the end").Default("4").Int()
+	importSort := importCmd.Flag("sort", "Input is not sorted by time (e.g. grouped by series). Sort samples externally with bounded memory, using --data-dir for temporary files").Default("false").Bool()
+	importSortBuffer := importCmd.Flag("sort-buffer", "Number of samples to sort in memory at once for --sort, each ~200B. Larger buffer means less temporary files to merge").Default("1000000").Int()
+	importRelabel := extkingpin.RegisterPathOrContent(importCmd, "relabel-config", fmt.Sprintf("YAML file that contains relabeling configuration applied to each series. Set %s=name1;name2;... to split separate blocks for each uniq label combination.", metaExtLabels), extkingpin.WithEnvSubstitution())
+	importCSVName := importCmd.Flag("csv-name", "Metric name for all the CSV rows").String()
+	importCSVNameColumn := importCmd.Flag("csv-name-column", "CSV column with metric name, instead of --csv-name").String()
+	importCSVValueColumn := importCmd.Flag("csv-value-column", "CSV column with sample value").Default("value").String()
+	importCSVTimeColumn := importCmd.Flag("csv-timestamp-column", "CSV column with sample timestamp").Default("timestamp").String()
+	importCSVTimeFormat := importCmd.Flag("csv-time-format", "Format of CSV timestamp: rfc3339, unix (seconds, could be fractional), unix-ms or Go time layout (e.g. '2006-01-02 15:04:05')").Default("rfc3339").String()
+	importCSVLabels := importCmd.Flag("csv-label-column", "CSV column to use as label (repeated). Could be renamed as <label>=<column>. All the other columns are used as labels by default").PlaceHolder("<label>=<column>").Strings()
+	importCSVDelimiter := importCmd.Flag("csv-delimiter", "CSV fields delimiter").Default(",").String()
 
 	unwrapCmd := app.Command("unwrap", "Split TSDB block to multiple blocks by Label")
 	unwrapRelabel := extkingpin.RegisterPathOrContent(unwrapCmd, "relabel-config", fmt.Sprintf("YAML file that contains relabeling configuration. Set %s=name1;name2;... to split separate blocks for each uniq label combination.", metaExtLabels), extkingpin.WithEnvSubstitution(), extkingpin.WithRequired())
 	unwrapMetaRelabel := extkingpin.RegisterPathOrContent(unwrapCmd, "meta-relabel", "YAML file that contains relabeling configuration for block labels (meta.json)", extkingpin.WithEnvSubstitution())
 	unwrapRecursive := unwrapCmd.Flag("recursive", "Recursive search for blocks in the bucket (Mimir has blocks nested to tenants folders)").Short('r').Default("false").Bool()
+	unwrapSelector, unwrapMaxTime, unwrapDataMinTime, unwrapDataMaxTime := blockFilterFlags(unwrapCmd, "Unwrap")
 	unwrapDir := unwrapCmd.Flag("data-dir", "Data directory in which to cache blocks and process tsdb.").Default("./data").String()
 	unwrapWait := unwrapCmd.Flag("wait-interval", "Wait interval between consecutive runs and bucket refreshes. Run once if 0.").Default("5m").Short('w').Duration()
 	unwrapDry := unwrapCmd.Flag("dry-run", "Don't do any changes to bucket. Only print what would be done.").Default("false").Bool()
 	unwrapDst := extkingpin.RegisterPathOrContent(unwrapCmd, "dst.config", "YAML file that contains destination object store configuration for generated blocks.", extkingpin.WithEnvSubstitution(), extkingpin.WithRequired())
-	unwrapMaxTime := model.TimeOrDuration(unwrapCmd.Flag("max-time", "End of time range limit to get blocks. Unwrap only those, which happened earlier than this value. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
-		Default("9999-12-31T23:59:59Z"))
 	unwrapSrc := unwrapCmd.Flag("source", "Only process blocks produced by this source (e.g `compactor`). Empty means process all blocks").Default("").String()
+	unwrapConcurrency := unwrapCmd.Flag("concurrency", "Number of blocks to process in parallel. Each one needs disk space in --data-dir for original and unwrapped blocks").Default("1").Int()
+	unwrapOnSuccess := unwrapCmd.Flag("on-success", "What to do with the original block after all unwrapped blocks are uploaded: delete it, mark it for deletion by compactor (deletion-mark.json), keep it, or move it under --archive-prefix. Kept block data is not changed, but unwrap-mark.json is written to the block dir, so it is not unwrapped again.").Default("delete").Enum("delete", "mark-deletion", "keep", "move")
+	unwrapArchivePrefix := unwrapCmd.Flag("archive-prefix", "Bucket prefix to move original blocks to for --on-success=move. Blocks under this prefix are not unwrapped.").Default("unwrapped/").String()
+	unwrapHTTP := unwrapCmd.Flag("http-address", "Listen host:port for HTTP endpoints (/metrics, /-/healthy, /-/ready). Disabled when empty.").Default("").String()
 
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 	var logger log.Logger
@@ -89,19 +140,44 @@ func main() {
 		exitCode(err)
 	}
 
+	// first signal cancels ctx for graceful shutdown, the second one kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		level.Info(logger).Log("msg", "received signal, shutting down")
+	}()
+
 	switch cmd {
 	case lsCmd.FullCommand():
-		exitCode(ls(bkt, lsRecursive, lsMaxTime))
+		exitCode(ls(ctx, bkt, lsRecursive, lsSelector, lsMaxTime, lsDataMinTime, lsDataMaxTime, lsOutput, logger))
 	case inspectCmd.FullCommand():
-		exitCode(inspect(bkt, inspectRecursive, inspectSelector, inspectSortBy, inspectMaxTime, logger))
+		exitCode(inspect(ctx, bkt, inspectRecursive, inspectSelector, inspectSortBy, inspectMaxTime, inspectDataMinTime, inspectDataMaxTime, inspectOutput, inspectGroupBy, *inspectHideMarked, *inspectOnlyMarked, logger))
+	case overlapsCmd.FullCommand():
+		exitCode(overlaps(ctx, bkt, overlapsRecursive, overlapsSelector, overlapsMaxTime, overlapsDataMinTime, overlapsDataMaxTime, overlapsMaxGap, logger))
+	case verifyCmd.FullCommand():
+		exitCode(verify(ctx, bkt, verifyULIDs, verifyRecursive, verifySelector, verifyMaxTime, verifyDataMinTime, verifyDataMaxTime, verifyDir, *verifyMark, logger))
+	case markCmd.FullCommand():
+		exitCode(mark(ctx, bkt, markULIDs, markMarker, markDetails, markReason, *markRemove, *markDry, markRecursive, markSelector, markMaxTime, markDataMinTime, markDataMaxTime, logger))
+	case copyCmd.FullCommand():
+		exitCode(copyBlocks(ctx, bkt, copyULIDs, copyRecursive, copySelector, copyMaxTime, copyDataMinTime, copyDataMaxTime, copyDst, copyPrefixMap, *copyDry, logger))
 	case analyzeCmd.FullCommand():
-		exitCode(analyze(bkt, analyzeULID, analyzeDir, analyzeLimit, analyzeMatchers, logger))
+		exitCode(analyze(ctx, bkt, analyzeULID, analyzeDir, analyzeLimit, analyzeMatchers, logger))
 	case dumpCmd.FullCommand():
-		exitCode(dump(bkt, os.Stdout, dumpULIDs, dumpDir, dumpMinTime, dumpMaxTime, dumpMatch, logger))
+		exitCode(dump(ctx, bkt, os.Stdout, dumpULIDs, dumpDir, dumpMinTime, dumpMaxTime, dumpMatch, logger))
 	case importCmd.FullCommand():
-		exitCode(importMetrics(bkt, importFromFile, importBlockSize, importDir, importLabels, *importUpload, logger))
+		csv := csvConfig{
+			name:         *importCSVName,
+			nameColumn:   *importCSVNameColumn,
+			valueColumn:  *importCSVValueColumn,
+			timeColumn:   *importCSVTimeColumn,
+			timeFormat:   *importCSVTimeFormat,
+			labelColumns: *importCSVLabels,
+			delimiter:    *importCSVDelimiter,
+		}
+		exitCode(importMetrics(ctx, bkt, importFromFile, inputFormat{name: *importFormat, csv: csv}, *importRelabel, importBlockSize, importDir, importLabels, *importUpload, *importMaxOpen, *importSort, *importSortBuffer, logger))
 	case unwrapCmd.FullCommand():
-		exitCode(unwrap(bkt, *unwrapRelabel, *unwrapMetaRelabel, *unwrapRecursive, unwrapDir, unwrapWait, *unwrapDry, unwrapDst, unwrapMaxTime, unwrapSrc, logger))
+		exitCode(unwrap(ctx, bkt, *unwrapRelabel, *unwrapMetaRelabel, *unwrapRecursive, unwrapSelector, unwrapDir, unwrapWait, *unwrapDry, unwrapDst, unwrapMaxTime, unwrapDataMinTime, unwrapDataMaxTime, unwrapSrc, *unwrapConcurrency, *unwrapOnSuccess, unwrapArchivePrefix, *unwrapHTTP, logger))
 	}
 }
 
@@ -112,3 +188,15 @@ func exitCode(err error) {
 	}
 	return
 }
+
+// blockFilterFlags registers flags to select blocks by labels and time, shared by commands working with multiple blocks.
+// verb is what the command does with selected blocks, e.g. "List"
+func blockFilterFlags(cmd *kingpin.CmdClause, verb string) (selector *[]string, maxTime, dataMinTime, dataMaxTime *model.TimeOrDurationValue) {
+	const timeHelp = "Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y."
+	selector = cmd.Flag("label", `Filter by Thanos block labels, e.g. '-l key1="value1" -l key2="value2"' or '-l {key1=~"value.*",key2!="value2"}'. All matchers must match. To select all blocks for some key use "*" as value.`).Short('l').PlaceHolder(`<selector>`).Strings()
+	maxTime = model.TimeOrDuration(cmd.Flag("max-time", fmt.Sprintf("End of time range limit to get blocks. %s only those, which happened earlier than this value. %s", verb, timeHelp)).
+		Default("9999-12-31T23:59:59Z"))
+	dataMinTime = model.TimeOrDuration(cmd.Flag("data-min-time", fmt.Sprintf("Start of data time range. %s only blocks which have data (meta.json minTime/maxTime) overlapping with --data-min-time/--data-max-time range. %s", verb, timeHelp)))
+	dataMaxTime = model.TimeOrDuration(cmd.Flag("data-max-time", fmt.Sprintf("End of data time range. %s only blocks which have data (meta.json minTime/maxTime) overlapping with --data-min-time/--data-max-time range. %s", verb, timeHelp)))
+	return selector, maxTime, dataMinTime, dataMaxTime
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/thanos-io/objstore/client"
 	"math"
@@ -11,8 +12,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/efficientgo/tools/extkingpin"
 	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 func Test_e2e(t *testing.T) {
@@ -33,6 +37,17 @@ func Test_e2e(t *testing.T) {
 	for i := end - 3600; i <= end; i += 15 {
 		fmt.Fprintf(f, "test_metric_one{label=\"test1\"} %g %d000\n", float64(rand.Int()), i)
 		fmt.Fprintf(f, "test_metric_two{label=\"test2\", new=\"another label\"} %g %d500\n", rand.Float64(), i)
+		n := i - end + 3600
+		h := &histogram.Histogram{
+			Count:           uint64(2 * n),
+			Sum:             rand.Float64(),
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+			PositiveBuckets: []int64{n, 0},
+		}
+		fmt.Fprintf(f, "test_histogram{label=\"test3\"} %s %d000\n", formatHistogram(h, nil), i)
+		fh := h.ToFloat()
+		fh.CounterResetHint = histogram.GaugeType
+		fmt.Fprintf(f, "test_gauge_histogram{label=\"test4\"} %s %d000\n", formatHistogram(nil, fh), i)
 	}
 	f.Close()
 
@@ -43,11 +58,12 @@ func Test_e2e(t *testing.T) {
 		t.Fatalf("Open bucket: %v", err)
 	}
 	blockSize := 2 * time.Hour
+	relabelConfig := extkingpin.RegisterPathOrContent(kingpin.New("test", ""), "relabel-config", "")
 	importLabels := []string{
 		`prometheus="prometheus-a"`,
 		"datacenter=us",
 	}
-	if err := importMetrics(bkt, &inputFile, &blockSize, &cacheDir, &importLabels, true, logger); err != nil {
+	if err := importMetrics(context.Background(), bkt, &[]string{inputFile}, inputFormat{name: "prom"}, *relabelConfig, &blockSize, &cacheDir, &importLabels, true, 4, false, 0, logger); err != nil {
 		t.Fatalf("Import of %s failed: %v", inputFile, err)
 	}
 	os.RemoveAll(cacheDir)
@@ -74,7 +90,7 @@ func Test_e2e(t *testing.T) {
 	minT := int64(0)
 	maxT := int64(math.MaxInt64)
 	match := "{__name__=~'(?s:.*)'}"
-	if err := dump(bkt, f, &ids, &cacheDir, &minT, &maxT, &match, logger); err != nil {
+	if err := dump(context.Background(), bkt, f, &ids, &cacheDir, &minT, &maxT, &match, logger); err != nil {
 		t.Fatalf("Export of %s failed: %v", ids, err)
 	}
 	f.Close()
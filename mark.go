@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/model"
+	"strings"
+)
+
+var markers = map[string]string{
+	"deletion":      metadata.DeletionMarkFilename,
+	"no-compact":    metadata.NoCompactMarkFilename,
+	"no-downsample": metadata.NoDownsampleMarkFilename,
+}
+
+func mark(ctx context.Context, bkt objstore.Bucket, ids *[]string, marker *string, details *string, reason *string, remove bool, dryRun bool, recursive *bool, selector *[]string, maxTime, dataMinTime, dataMaxTime *model.TimeOrDurationValue, logger log.Logger) error {
+	sel, err := parseSelector(*selector)
+	if err != nil {
+		return errors.Wrap(err, "error parsing selector flag")
+	}
+	mint, maxt, rangeSet := dataRange(dataMinTime, dataMaxTime)
+	if len(*ids) == 0 && sel.Empty() && !rangeSet {
+		return errors.New("refusing to mark all blocks in the bucket, specify ULIDs, --label or --data-min-time/--data-max-time")
+	}
+
+	metas, err := getAllMetas(ctx, bkt, *recursive, maxTime, logger)
+	if err != nil {
+		return err
+	}
+	selected := filterIDs(selectMetas(metas, sel, mint, maxt), *ids)
+	if missing := missingIDs(selected, *ids); len(missing) > 0 {
+		return errors.Errorf("requested blocks are not found or filtered out: %s", strings.Join(missing, ", "))
+	}
+
+	counter := noopCounter()
+	for _, m := range selected {
+		pb := objstore.NewPrefixedBucket(bkt, m.Prefix)
+		if dryRun {
+			level.Info(logger).Log("msg", "dry-run: skipping marker change", "marker", *marker, "remove", remove, "id", m.Prefix+m.ULID.String())
+			continue
+		}
+		switch {
+		case remove:
+			err = block.RemoveMark(ctx, logger, pb, m.ULID, counter, markers[*marker])
+		case *marker == "deletion":
+			err = block.MarkForDeletion(ctx, logger, pb, m.ULID, *details, counter)
+		case *marker == "no-compact":
+			err = block.MarkForNoCompact(ctx, logger, pb, m.ULID, metadata.NoCompactReason(*reason), *details, counter)
+		case *marker == "no-downsample":
+			err = block.MarkForNoDownsample(ctx, logger, pb, m.ULID, metadata.NoDownsampleReason(*reason), *details, counter)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "%s%s", m.Prefix, m.ULID)
+		}
+	}
+	level.Info(logger).Log("msg", "done", "blocks", len(selected))
+	return nil
+}
+
+// noopCounter returns not registered counter, for thanos block functions requiring one
+func noopCounter() prometheus.Counter {
+	return promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+}
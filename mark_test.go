@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/model"
+)
+
+func Test_markMissingIDs(t *testing.T) {
+	bkt := objstore.NewInMemBucket()
+	id1, missing := ulid.MustNew(1, nil), ulid.MustNew(3, nil)
+	uploadTestMeta(t, bkt, "", id1, map[string]string{"p": "a"})
+
+	ids, marker, details, reason, recursive, selector := []string{id1.String(), missing.String()}, "deletion", "", "", false, []string{}
+	err := mark(context.Background(), bkt, &ids, &marker, &details, &reason, false, false, &recursive, &selector, testTime(t, "9999-12-31T23:59:59Z"), &model.TimeOrDurationValue{}, &model.TimeOrDurationValue{}, log.NewNopLogger())
+	if err == nil || !strings.Contains(err.Error(), missing.String()) || strings.Contains(err.Error(), id1.String()) {
+		t.Fatalf("mark(%q)=%v, wants %s to be reported", ids, err, missing)
+	}
+	if ok, _ := bkt.Exists(context.Background(), id1.String()+"/"+metadata.DeletionMarkFilename); ok {
+		t.Errorf("mark(%q) marked %s, wants nothing to be marked", ids, id1)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/model"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Issue is a time range problem found between blocks of the same stream
+type Issue struct {
+	Kind    string // overlap or gap
+	Prefix  string
+	Labels  string
+	Res     int64
+	MinTime int64
+	MaxTime int64
+	Blocks  []string
+}
+
+func overlaps(ctx context.Context, bkt objstore.Bucket, recursive *bool, selector *[]string, maxTime, dataMinTime, dataMaxTime *model.TimeOrDurationValue, maxGap *time.Duration, logger log.Logger) error {
+	sel, err := parseSelector(*selector)
+	if err != nil {
+		return errors.Wrap(err, "error parsing selector flag")
+	}
+	metas, err := getAllMetas(ctx, bkt, *recursive, maxTime, logger)
+	if err != nil {
+		return err
+	}
+	mint, maxt, _ := dataRange(dataMinTime, dataMaxTime)
+	selected := selectMetas(metas, sel, mint, maxt)
+
+	issues := findIssues(selected, maxGap.Milliseconds())
+	if len(issues) == 0 {
+		return nil
+	}
+	if err := printIssues(os.Stdout, issues, *recursive); err != nil {
+		return err
+	}
+	return errors.Errorf("found %d issues in %d blocks", len(issues), len(selected))
+}
+
+// findIssues groups metas to streams by prefix, Thanos labels and resolution (same as compactor does)
+// and returns overlaps and gaps longer than maxGap (0 to skip gaps check) in each stream
+func findIssues(metas []*Meta, maxGap int64) (issues []Issue) {
+	streams := map[string][]*Meta{}
+	for _, m := range metas {
+		key := fmt.Sprintf("%s|%s|%d", m.Prefix, labelsToString(m.Thanos.Labels), m.Thanos.Downsample.Resolution)
+		streams[key] = append(streams[key], m)
+	}
+
+	for _, stream := range streams {
+		sort.Slice(stream, func(i, j int) bool {
+			if stream[i].MinTime == stream[j].MinTime {
+				return stream[i].ULID.Compare(stream[j].ULID) < 0
+			}
+			return stream[i].MinTime < stream[j].MinTime
+		})
+		newIssue := func(kind string, mint, maxt int64) Issue {
+			return Issue{
+				Kind:    kind,
+				Prefix:  stream[0].Prefix,
+				Labels:  labelsToString(stream[0].Thanos.Labels),
+				Res:     stream[0].Thanos.Downsample.Resolution,
+				MinTime: mint,
+				MaxTime: maxt,
+			}
+		}
+
+		bm := make([]tsdb.BlockMeta, 0, len(stream))
+		for _, m := range stream {
+			bm = append(bm, m.BlockMeta)
+		}
+		for r, blocks := range tsdb.OverlappingBlocks(bm) {
+			issue := newIssue("overlap", r.Min, r.Max)
+			for _, b := range blocks {
+				issue.Blocks = append(issue.Blocks, b.ULID.String())
+			}
+			issues = append(issues, issue)
+		}
+
+		if maxGap <= 0 {
+			continue
+		}
+		end := stream[0]
+		for _, m := range stream[1:] {
+			if m.MinTime-end.MaxTime > maxGap {
+				issue := newIssue("gap", end.MaxTime, m.MinTime)
+				issue.Blocks = []string{end.ULID.String(), m.ULID.String()}
+				issues = append(issues, issue)
+			}
+			if m.MaxTime > end.MaxTime {
+				end = m
+			}
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		switch {
+		case a.Prefix != b.Prefix:
+			return a.Prefix < b.Prefix
+		case a.Labels != b.Labels:
+			return a.Labels < b.Labels
+		case a.Res != b.Res:
+			return a.Res < b.Res
+		}
+		return a.MinTime < b.MinTime
+	})
+	return issues
+}
+
+func printIssues(w io.Writer, issues []Issue, recursive bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "TYPE\tFROM\tTO\tRANGE\tRES\tLABELS\tBLOCKS"
+	if recursive {
+		header = "DIR\t" + header
+	}
+	fmt.Fprintln(tw, header)
+	for _, i := range issues {
+		if recursive {
+			fmt.Fprintf(tw, "%s\t", i.Prefix)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			i.Kind,
+			time.Unix(i.MinTime/1000, 0).Format("2006-01-02 15:04:05"),
+			time.Unix(i.MaxTime/1000, 0).Format("2006-01-02 15:04:05"),
+			humanizeDuration(time.Duration(i.MaxTime-i.MinTime)*time.Millisecond),
+			humanizeDuration(time.Duration(i.Res)*time.Millisecond),
+			i.Labels,
+			strings.Join(i.Blocks, ","),
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+)
+
+func Test_findIssues(t *testing.T) {
+	newMeta := func(id uint64, mint, maxt int64, lbl string) *Meta {
+		m := &Meta{}
+		m.ULID = ulid.MustNew(id, nil)
+		m.MinTime, m.MaxTime = mint, maxt
+		m.Thanos.Labels = map[string]string{"p": lbl}
+		return m
+	}
+	metas := []*Meta{
+		newMeta(1, 0, 100, "a"),
+		newMeta(2, 100, 200, "a"),
+		newMeta(3, 150, 250, "a"), // overlaps with 2
+		newMeta(4, 400, 500, "a"), // gap 250-400
+		newMeta(5, 0, 100, "b"),   // other stream
+		newMeta(6, 120, 200, "b"), // gap 100-120
+	}
+
+	issues := findIssues(metas, 50)
+	if len(issues) != 2 {
+		t.Fatalf("findIssues()=%d issues, wants 2: %+v", len(issues), issues)
+	}
+	if i := issues[0]; i.Kind != "overlap" || i.MinTime != 150 || i.MaxTime != 200 || len(i.Blocks) != 2 {
+		t.Errorf("findIssues()[0]=%+v, wants overlap 150-200", i)
+	}
+	if i := issues[1]; i.Kind != "gap" || i.MinTime != 250 || i.MaxTime != 400 {
+		t.Errorf("findIssues()[1]=%+v, wants gap 250-400", i)
+	}
+
+	if issues := findIssues(metas, 0); len(issues) != 1 {
+		t.Errorf("findIssues() without gaps check=%d issues, wants 1", len(issues))
+	}
+}
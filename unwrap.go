@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/efficientgo/tools/extkingpin"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/version"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/storage"
@@ -17,9 +24,14 @@ import (
 	"github.com/thanos-io/objstore/client"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/model"
+	"github.com/thanos-io/thanos/pkg/prober"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	httpserver "github.com/thanos-io/thanos/pkg/server/http"
+	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v2"
+	"io/fs"
 	"math"
 	"os"
 	"path"
@@ -27,12 +39,60 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const metaExtLabels = "__meta_ext_labels"
+const (
+	metaExtLabels = "__meta_ext_labels"
+	// UnwrapMarkFilename is stored in the original block dir while unwrapped blocks are uploaded,
+	// so that unwrap could be resumed after crash without duplicates in the destination bucket
+	UnwrapMarkFilename = "unwrap-mark.json"
+	UnwrapMarkVersion1 = 1
+
+	// --on-success policies for the original block
+	onSuccessDelete       = "delete"
+	onSuccessMarkDeletion = "mark-deletion"
+	onSuccessKeep         = "keep"
+	onSuccessMove         = "move"
+)
+
+// UnwrapMark stores ids of blocks produced from the original block
+type UnwrapMark struct {
+	ID      ulid.ULID   `json:"id"`
+	Version int         `json:"version"`
+	Blocks  []ulid.ULID `json:"blocks"`
+	// UnwrapTime is a unix timestamp of when the unwrapped blocks upload has started
+	UnwrapTime int64 `json:"unwrap_time"`
+	// FinishTime is a unix timestamp of when the original block was processed according to --on-success policy.
+	// Blocks with finished unwrap are skipped, when the original is not deleted right away.
+	FinishTime int64 `json:"finish_time,omitempty"`
+}
+
+func unwrap(ctx context.Context, bkt objstore.Bucket, unwrapRelabel extkingpin.PathOrContent, unwrapMetaRelabel extkingpin.PathOrContent, recursive bool, selector *[]string, dir *string, wait *time.Duration, unwrapDry bool, outConfig *extkingpin.PathOrContent, maxTime, dataMinTime, dataMaxTime *model.TimeOrDurationValue, unwrapSrc *string, concurrency int, onSuccess string, archivePrefix *string, httpAddr string, logger log.Logger) (err error) {
+	if concurrency < 1 {
+		return fmt.Errorf("--concurrency should be at least 1, got %d", concurrency)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		version.NewCollector("thanos_kit"),
+	)
+	metrics := newUnwrapMetrics(reg)
+	probe := prober.NewHTTP()
+	if httpAddr != "" {
+		srv := httpserver.New(logger, reg, component.Bucket, probe, httpserver.WithListen(httpAddr), httpserver.WithGracePeriod(5*time.Second))
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				level.Error(logger).Log("msg", "http server failed", "err", err)
+			}
+		}()
+		defer srv.Shutdown(nil)
+	}
+	probe.Healthy()
 
-func unwrap(bkt objstore.Bucket, unwrapRelabel extkingpin.PathOrContent, unwrapMetaRelabel extkingpin.PathOrContent, recursive bool, dir *string, wait *time.Duration, unwrapDry bool, outConfig *extkingpin.PathOrContent, maxTime *model.TimeOrDurationValue, unwrapSrc *string, logger log.Logger) (err error) {
 	relabelContentYaml, err := unwrapRelabel.Content()
 	if err != nil {
 		return fmt.Errorf("get content of relabel configuration: %w", err)
@@ -50,6 +110,15 @@ func unwrap(bkt objstore.Bucket, unwrapRelabel extkingpin.PathOrContent, unwrapM
 		return fmt.Errorf("parse relabel configuration: %w", err)
 	}
 
+	sel, err := parseSelector(*selector)
+	if err != nil {
+		return fmt.Errorf("parse selector flag: %w", err)
+	}
+	archive := strings.Trim(*archivePrefix, "/") + "/"
+	if onSuccess == onSuccessMove && archive == "/" {
+		return fmt.Errorf("--archive-prefix should not be empty for --on-success=%s", onSuccessMove)
+	}
+
 	objStoreYaml, err := outConfig.Content()
 	if err != nil {
 		return err
@@ -59,46 +128,88 @@ func unwrap(bkt objstore.Bucket, unwrapRelabel extkingpin.PathOrContent, unwrapM
 		return err
 	}
 
+	// ready only when setup is done, and not ready during shutdown
+	probe.Ready()
+	go func() {
+		<-ctx.Done()
+		probe.NotReady(ctx.Err())
+	}()
+
 	processBucket := func() error {
 		begin := time.Now()
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		ctxl, cancel := context.WithTimeout(ctx, 10*time.Minute)
 		defer cancel()
-		blocks, err := getBlocks(ctx, bkt, recursive, maxTime)
+		metas, err := getAllMetas(ctxl, bkt, recursive, maxTime, logger)
 		if err != nil {
 			return err
 		}
-		for _, b := range blocks {
-			if *unwrapSrc != "" {
-				m, err := getMeta(ctx, b, bkt, logger)
-				if bkt.IsObjNotFoundErr(err) {
-					continue // Meta.json was deleted between bkt.Exists and here.
+		mint, maxt, _ := dataRange(dataMinTime, dataMaxTime)
+		blocks := selectMetas(metas, sel, mint, maxt)
+		// leftovers of previous runs
+		if err := runutil.DeleteAll(*dir); err != nil {
+			return fmt.Errorf("unable to cleanup cache folder %s: %w", *dir, err)
+		}
+
+		// each worker uses own sub-dir, so disk usage is bounded by concurrency * (block size + unwrapped blocks size)
+		var failed atomic.Int64
+		eg := errgroup.Group{}
+		eg.SetLimit(concurrency)
+		for _, m := range blocks {
+			if *unwrapSrc != "" && string(m.Thanos.Source) != *unwrapSrc {
+				continue
+			}
+			if onSuccess == onSuccessMove && strings.HasPrefix(m.Prefix, archive) {
+				continue
+			}
+			m, b := m, Block{Prefix: m.Prefix, Id: m.ULID}
+			eg.Go(func() error {
+				if ctx.Err() != nil {
+					return nil // shutting down, do not start new blocks
 				}
-				if err != nil {
-					return err
+				bdir := filepath.Join(*dir, b.Id.String())
+				err := unwrapBlock(ctx, bkt, m, relabelConfig, metaRelabel, bdir, unwrapDry, dst, onSuccess, archive, metrics, logger)
+				if errors.Is(err, context.Canceled) {
+					level.Info(logger).Log("msg", "unwrap of block aborted", "id", b.Prefix+b.Id.String())
+				} else if err != nil {
+					// do not stop the whole iteration because of one broken block
+					level.Error(logger).Log("msg", "failed to unwrap block", "id", b.Prefix+b.Id.String(), "err", err)
+					failed.Add(1)
+					metrics.blocksFailed.Inc()
 				}
-				if string(m.Thanos.Source) != *unwrapSrc {
-					continue
+				if err := os.RemoveAll(bdir); err != nil {
+					level.Warn(logger).Log("msg", "unable to cleanup cache folder", "dir", bdir, "err", err)
 				}
-			}
-			if err := unwrapBlock(bkt, b, relabelConfig, metaRelabel, *dir, unwrapDry, dst, logger); err != nil {
-				return err
-			}
+				return nil
+			})
+		}
+		eg.Wait()
+		metrics.iterationDuration.Observe(time.Since(begin).Seconds())
+		if failed.Load() == 0 {
+			metrics.lastSuccess.SetToCurrentTime()
+		}
+		level.Info(logger).Log("msg", "bucket iteration done", "blocks", len(blocks), "failed", failed.Load(), "duration", time.Since(begin), "sleeping", wait)
+		// one-shot run should not look successful, when some blocks are aborted or not started
+		if *wait == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if *wait == 0 && failed.Load() > 0 {
+			return fmt.Errorf("failed to unwrap %d blocks", failed.Load())
 		}
-		level.Info(logger).Log("msg", "bucket iteration done", "blocks", len(blocks), "duration", time.Since(begin), "sleeping", wait)
 		return nil
 	}
 
 	if *wait == 0 {
 		return processBucket()
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	return runutil.Repeat(*wait, ctx.Done(), func() error {
 		return processBucket()
 	})
 }
 
-func unwrapBlock(bkt objstore.Bucket, b Block, relabelConfig []*relabel.Config, metaRelabel []*relabel.Config, dir string, unwrapDry bool, dst objstore.Bucket, logger log.Logger) error {
+// unwrapBlock could be aborted via ctx until upload of unwrapped blocks. When upload is interrupted, already
+// uploaded blocks are deleted, while processing of the original block after the upload is not interruptible.
+func unwrapBlock(ctx context.Context, bkt objstore.Bucket, m *Meta, relabelConfig []*relabel.Config, metaRelabel []*relabel.Config, dir string, unwrapDry bool, dst objstore.Bucket, onSuccess, archivePrefix string, metrics *unwrapMetrics, logger log.Logger) error {
+	b := Block{Prefix: m.Prefix, Id: m.ULID}
 	if err := runutil.DeleteAll(dir); err != nil {
 		return fmt.Errorf("unable to cleanup cache folder %s: %w", dir, err)
 	}
@@ -111,12 +222,18 @@ func unwrapBlock(bkt objstore.Bucket, b Block, relabelConfig []*relabel.Config,
 	}
 
 	// prepare input
-	ctxd, canceld := context.WithTimeout(context.Background(), 10*time.Minute)
+	ctxd, canceld := context.WithTimeout(ctx, 10*time.Minute)
 	defer canceld()
 	pb := objstore.NewPrefixedBucket(bkt, b.Prefix)
+	if done, err := resumeUnwrap(ctxd, bkt, m, dst, unwrapDry, onSuccess, archivePrefix, metrics, logger); err != nil || done {
+		return err
+	}
 	if err := downloadBlock(ctxd, inDir, b.Id.String(), pb, logger); err != nil {
 		return err
 	}
+	if size, err := dirSize(inDir); err == nil {
+		metrics.downloadedBytes.Add(float64(size))
+	}
 	os.Mkdir(path.Join(inDir, "wal"), 0777)
 	origMeta, err := metadata.ReadFromDir(path.Join(inDir, b.Id.String()))
 	if err != nil {
@@ -134,7 +251,7 @@ func unwrapBlock(bkt objstore.Bucket, b Block, relabelConfig []*relabel.Config,
 	defer func() {
 		err = tsdb_errors.NewMulti(err, db.Close()).Err()
 	}()
-	q, err := db.Querier(context.Background(), 0, math.MaxInt64)
+	q, err := db.Querier(ctx, 0, math.MaxInt64)
 	if err != nil {
 		return err
 	}
@@ -142,7 +259,9 @@ func unwrapBlock(bkt objstore.Bucket, b Block, relabelConfig []*relabel.Config,
 
 	// prepare output
 	os.Mkdir(outDir, 0777)
-	duration := getCompatibleBlockDuration(math.MaxInt64) //todo
+	// series are written one by one, and head of BlockWriter rejects samples older than half of its chunk range
+	// from the max time already appended. So it should be at least twice as large as the original block range.
+	duration := max(2*(origMeta.MaxTime-origMeta.MinTime), tsdb.DefaultBlockDuration)
 	mw, err := newMultiBlockWriter(outDir, logger, duration, *origMeta)
 	if err != nil {
 		return err
@@ -151,6 +270,9 @@ func unwrapBlock(bkt objstore.Bucket, b Block, relabelConfig []*relabel.Config,
 	// unwrap
 	ss := q.Select(false, nil, matchAll)
 	for ss.Next() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		series := ss.At()
 		rl, keep := relabel.Process(series.Labels(), relabelConfig...)
 		if !keep {
@@ -158,34 +280,35 @@ func unwrapBlock(bkt objstore.Bucket, b Block, relabelConfig []*relabel.Config,
 		}
 
 		lbs, extl := extractLabels(rl, strings.Split(rl.Get(metaExtLabels), ";"))
-		tdb, err := mw.getTenant(context.Background(), extl)
+		tdb, err := mw.getTenant(ctx, extl)
 		if err != nil {
 			return err
 		}
+		samples := tdb.samples
 		it := series.Iterator(nil)
-		for it.Next() == chunkenc.ValFloat {
-			ts, val := it.At()
-			if _, err := tdb.appender.Append(0, lbs, ts, val); err != nil {
-				return err
+		for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+			switch vt {
+			case chunkenc.ValFloat:
+				ts, val := it.At()
+				_, err = tdb.appender.Append(0, lbs, ts, val)
+			case chunkenc.ValHistogram:
+				ts, h := it.AtHistogram()
+				_, err = tdb.appender.AppendHistogram(0, lbs, ts, h, nil)
+			case chunkenc.ValFloatHistogram:
+				ts, fh := it.AtFloatHistogram()
+				_, err = tdb.appender.AppendHistogram(0, lbs, ts, nil, fh)
 			}
-			tdb.samples++
-		}
-		for it.Next() == chunkenc.ValFloatHistogram {
-			ts, fh := it.AtFloatHistogram()
-			if _, err := tdb.appender.AppendHistogram(0, lbs, ts, nil, fh); err != nil {
-				return err
-			}
-			tdb.samples++
-		}
-		for it.Next() == chunkenc.ValHistogram {
-			ts, h := it.AtHistogram()
-			if _, err := tdb.appender.AppendHistogram(0, lbs, ts, h, nil); err != nil {
+			if err != nil {
 				return err
 			}
 			tdb.samples++
 		}
 		if it.Err() != nil {
-			return ss.Err()
+			return it.Err()
+		}
+		metrics.series.WithLabelValues(tdb.name).Inc()
+		if tdb.samples > samples {
+			metrics.samples.WithLabelValues(tdb.name).Add(float64(tdb.samples - samples))
 		}
 	}
 
@@ -196,28 +319,171 @@ func unwrapBlock(bkt objstore.Bucket, b Block, relabelConfig []*relabel.Config,
 		return tsdb_errors.NewMulti(ws...).Err()
 	}
 
-	blocks, err := mw.flush(context.Background())
+	blocks, err := mw.flush(ctx)
+	if err != nil {
+		return err
+	}
 	if unwrapDry {
-		level.Info(logger).Log("msg", "dry-run: skipping upload of created blocks and delete of original block", "ulids", fmt.Sprint(blocks), "orig", b.Id)
+		level.Info(logger).Log("msg", "dry-run: skipping upload of created blocks and processing of original block", "ulids", fmt.Sprint(blocks), "orig", b.Id, "on-success", onSuccess)
 	} else {
+		ctxm, cancelm := context.WithTimeout(ctx, 10*time.Minute)
+		defer cancelm()
+		mark := UnwrapMark{
+			ID:         b.Id,
+			Version:    UnwrapMarkVersion1,
+			Blocks:     blocks,
+			UnwrapTime: time.Now().Unix(),
+		}
+		if err := writeUnwrapMark(ctxm, pb, mark); err != nil {
+			return err
+		}
 		for _, id := range blocks {
 			begin := time.Now()
-			ctxu, cancelu := context.WithTimeout(context.Background(), 10*time.Minute)
+			ctxu, cancelu := context.WithTimeout(ctx, 10*time.Minute)
 			defer cancelu()
-			err = block.Upload(ctxu, logger, dst, filepath.Join(outDir, id.String()), metadata.SHA256Func)
+			bdir := filepath.Join(outDir, id.String())
+			err = block.Upload(ctxu, logger, dst, bdir, metadata.SHA256Func)
 			if err != nil {
-				return fmt.Errorf("upload block %s: %v", id, err)
+				ctxa, cancela := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Minute)
+				defer cancela()
+				if err := abortUnwrap(ctxa, pb, dst, mark, logger); err != nil {
+					level.Error(logger).Log("msg", "failed to cleanup partial upload", "ulid", b.Id, "err", err)
+				}
+				return fmt.Errorf("upload block %s: %w", id, err)
+			}
+			if size, err := dirSize(bdir); err == nil {
+				metrics.uploadedBytes.Add(float64(size))
 			}
 			level.Info(logger).Log("msg", "uploaded block", "ulid", id, "duration", time.Since(begin))
 		}
-		level.Info(logger).Log("msg", "deleting original block", "ulid", b.Id)
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-		defer cancel()
-		if err := block.Delete(ctx, logger, pb, b.Id); err != nil {
-			return fmt.Errorf("delete block %s%s: %v", b.Prefix, b.Id, err)
+		ctxf, cancelf := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Minute)
+		defer cancelf()
+		if err := finishUnwrap(ctxf, bkt, m, mark, onSuccess, archivePrefix, logger); err != nil {
+			return err
+		}
+		metrics.blocksProcessed.Inc()
+	}
+
+	return nil
+}
+
+// finishUnwrap processes the original block according to --on-success policy, after all unwrapped blocks are uploaded.
+// Unless the block is deleted, unwrap-mark.json with FinishTime is written only after the policy is applied,
+// so the block is not skipped by the next run when the policy fails half-way
+func finishUnwrap(ctx context.Context, bkt objstore.Bucket, m *Meta, mark UnwrapMark, onSuccess, archivePrefix string, logger log.Logger) error {
+	pb := objstore.NewPrefixedBucket(bkt, m.Prefix)
+	mark.FinishTime = time.Now().Unix()
+	switch onSuccess {
+	case onSuccessDelete:
+		level.Info(logger).Log("msg", "deleting original block", "ulid", m.ULID)
+		if err := block.Delete(ctx, logger, pb, m.ULID); err != nil {
+			return fmt.Errorf("delete block %s%s: %v", m.Prefix, m.ULID, err)
+		}
+	case onSuccessMarkDeletion:
+		level.Info(logger).Log("msg", "marking original block for deletion", "ulid", m.ULID)
+		markedForDeletion := noopCounter()
+		if err := block.MarkForDeletion(ctx, logger, pb, m.ULID, "thanos-kit unwrap: block is unwrapped", markedForDeletion); err != nil {
+			return fmt.Errorf("mark block %s%s for deletion: %w", m.Prefix, m.ULID, err)
+		}
+		// original block stays in the bucket until compactor deletes it, so it should not be unwrapped again
+		if err := writeUnwrapMark(ctx, pb, mark); err != nil {
+			return err
+		}
+	case onSuccessMove:
+		level.Info(logger).Log("msg", "moving original block", "ulid", m.ULID, "to", archivePrefix+m.Prefix)
+		if err := copyBlock(ctx, bkt, bkt, m, archivePrefix+m.Prefix, logger); err != nil {
+			return fmt.Errorf("move block %s%s to %s: %w", m.Prefix, m.ULID, archivePrefix, err)
+		}
+		if err := writeUnwrapMark(ctx, objstore.NewPrefixedBucket(bkt, archivePrefix+m.Prefix), mark); err != nil {
+			return err
+		}
+		if err := block.Delete(ctx, logger, pb, m.ULID); err != nil {
+			return fmt.Errorf("delete block %s%s: %v", m.Prefix, m.ULID, err)
+		}
+	default:
+		level.Info(logger).Log("msg", "keeping original block", "ulid", m.ULID)
+		if err := writeUnwrapMark(ctx, pb, mark); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
+func writeUnwrapMark(ctx context.Context, bkt objstore.Bucket, m UnwrapMark) error {
+	mark, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("json encode unwrap mark: %w", err)
+	}
+	markFile := path.Join(m.ID.String(), UnwrapMarkFilename)
+	if err := bkt.Upload(ctx, markFile, bytes.NewReader(mark)); err != nil {
+		return fmt.Errorf("upload file %s to bucket: %w", markFile, err)
+	}
+	return nil
+}
+
+// resumeUnwrap checks for unwrap-mark.json left by previous run. When all the produced blocks are
+// in destination bucket, unwrap is finished by applying --on-success policy to the original block, and done is returned.
+// Otherwise, partially uploaded blocks are deleted from destination, so the block could be unwrapped from scratch.
+func resumeUnwrap(ctx context.Context, root objstore.Bucket, m *Meta, dst objstore.Bucket, unwrapDry bool, onSuccess, archivePrefix string, metrics *unwrapMetrics, logger log.Logger) (done bool, err error) {
+	b := Block{Prefix: m.Prefix, Id: m.ULID}
+	bkt := objstore.NewPrefixedBucket(root, b.Prefix)
+	markFile := path.Join(b.Id.String(), UnwrapMarkFilename)
+	r, err := bkt.Get(ctx, markFile)
+	if bkt.IsObjNotFoundErr(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("get %s: %w", markFile, err)
+	}
+	defer runutil.CloseWithLogOnErr(logger, r, "close bkt unwrap mark get")
+	var mark UnwrapMark
+	if err := json.NewDecoder(r).Decode(&mark); err != nil {
+		return false, fmt.Errorf("decode %s: %w", markFile, err)
+	}
+	if mark.FinishTime != 0 {
+		level.Debug(logger).Log("msg", "block is already unwrapped, skipping", "id", b.Prefix+b.Id.String(), "finished", time.Unix(mark.FinishTime, 0))
+		return true, nil
+	}
+
+	complete := true
+	for _, id := range mark.Blocks {
+		ok, err := dst.Exists(ctx, path.Join(id.String(), metadata.MetaFilename))
+		if err != nil {
+			return false, fmt.Errorf("check %s exists in destination: %w", id, err)
+		}
+		if !ok {
+			complete = false
+			break
+		}
+	}
+	if unwrapDry {
+		level.Info(logger).Log("msg", "dry-run: found unfinished unwrap of block", "id", b.Prefix+b.Id.String(), "ulids", fmt.Sprint(mark.Blocks), "complete", complete)
+		return false, nil
+	}
+
+	if complete {
+		level.Info(logger).Log("msg", "all unwrapped blocks are uploaded by previous run, finishing original block", "ulid", b.Id, "on-success", onSuccess)
+		if err := finishUnwrap(ctx, root, m, mark, onSuccess, archivePrefix, logger); err != nil {
+			return false, err
+		}
+		metrics.blocksProcessed.Inc()
+		return true, nil
+	}
+	level.Info(logger).Log("msg", "cleaning up partial upload of previous run", "ulid", b.Id, "ulids", fmt.Sprint(mark.Blocks))
+	return false, abortUnwrap(ctx, bkt, dst, mark, logger)
+}
+
+// abortUnwrap deletes unwrapped blocks listed in the mark from destination bucket, and then the mark itself
+func abortUnwrap(ctx context.Context, bkt objstore.Bucket, dst objstore.Bucket, mark UnwrapMark, logger log.Logger) error {
+	for _, id := range mark.Blocks {
+		if err := block.Delete(ctx, logger, dst, id); err != nil {
+			return fmt.Errorf("delete partially uploaded block %s: %w", id, err)
+		}
+	}
+	markFile := path.Join(mark.ID.String(), UnwrapMarkFilename)
+	if err := bkt.Delete(ctx, markFile); err != nil {
+		return fmt.Errorf("delete %s: %w", markFile, err)
+	}
 	return nil
 }
 
@@ -246,6 +512,72 @@ func extractLabels(ls labels.Labels, names []string) (res labels.Labels, el labe
 	return res, el
 }
 
+type unwrapMetrics struct {
+	blocksProcessed   prometheus.Counter
+	blocksFailed      prometheus.Counter
+	series            *prometheus.CounterVec
+	samples           *prometheus.CounterVec
+	downloadedBytes   prometheus.Counter
+	uploadedBytes     prometheus.Counter
+	iterationDuration prometheus.Histogram
+	lastSuccess       prometheus.Gauge
+}
+
+func newUnwrapMetrics(reg prometheus.Registerer) *unwrapMetrics {
+	f := promauto.With(reg)
+	return &unwrapMetrics{
+		blocksProcessed: f.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_kit_unwrap_blocks_processed_total",
+			Help: "Total number of original blocks successfully unwrapped.",
+		}),
+		blocksFailed: f.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_kit_unwrap_blocks_failed_total",
+			Help: "Total number of original blocks failed to unwrap.",
+		}),
+		series: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_kit_unwrap_series_total",
+			Help: "Total number of series written to unwrapped blocks per tenant (extracted labels).",
+		}, []string{"tenant"}),
+		samples: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_kit_unwrap_samples_total",
+			Help: "Total number of samples written to unwrapped blocks per tenant (extracted labels).",
+		}, []string{"tenant"}),
+		downloadedBytes: f.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_kit_unwrap_downloaded_bytes_total",
+			Help: "Total size of original blocks downloaded.",
+		}),
+		uploadedBytes: f.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_kit_unwrap_uploaded_bytes_total",
+			Help: "Total size of unwrapped blocks uploaded.",
+		}),
+		iterationDuration: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "thanos_kit_unwrap_iteration_duration_seconds",
+			Help:    "Duration of bucket iterations.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		}),
+		lastSuccess: f.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_kit_unwrap_last_successful_run_timestamp_seconds",
+			Help: "Timestamp of the last bucket iteration without failed blocks.",
+		}),
+	}
+}
+
+// dirSize returns total size of files in dir
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
 type MultiBlockWriter struct {
 	db        *tsdb.DBReadOnly
 	origMeta  metadata.Meta
@@ -257,6 +589,7 @@ type MultiBlockWriter struct {
 }
 
 type tenant struct {
+	name      string // ext labels string for metrics
 	appender  storage.Appender
 	writer    *tsdb.BlockWriter
 	samples   int
@@ -283,6 +616,7 @@ func (m *MultiBlockWriter) getTenant(ctx context.Context, lbls labels.Labels) (*
 		}
 		m.mu.Lock()
 		m.tenants[id] = &tenant{
+			name:      lbls.String(),
 			writer:    w,
 			appender:  w.Appender(ctx),
 			samples:   0,
@@ -330,14 +664,34 @@ func (m *MultiBlockWriter) flush(ctx context.Context) (ids []ulid.ULID, err erro
 		if err != nil {
 			return nil, fmt.Errorf("read %s metadata: %w", id, err)
 		}
-		l := m.origMeta.Thanos.Labels
+		l := make(map[string]string, len(m.origMeta.Thanos.Labels)+len(t.extLables))
+		for k, v := range m.origMeta.Thanos.Labels {
+			l[k] = v
+		}
 		for _, e := range t.extLables {
 			l[e.Name] = e.Value
 		}
-		if err = writeThanosMeta(meta.BlockMeta, l, m.origMeta.Thanos.Downsample.Resolution, m.dir, m.logger); err != nil {
+		if err = writeThanosMeta(m.unwrappedMeta(meta.BlockMeta), l, m.origMeta.Thanos.Downsample.Resolution, m.dir, m.logger); err != nil {
 			return nil, fmt.Errorf("write %s metadata: %w", id, err)
 		}
 	}
 	m.tenants = make(map[uint64]*tenant)
 	return ids, nil
 }
+
+// unwrappedMeta keeps time range, compaction level and sources of the original block, so that compactor
+// continues from the same level with the same alignment instead of compacting unwrapped blocks from scratch
+func (m *MultiBlockWriter) unwrappedMeta(meta tsdb.BlockMeta) tsdb.BlockMeta {
+	orig := m.origMeta.BlockMeta
+	sources := append([]ulid.ULID{}, orig.Compaction.Sources...)
+	if len(sources) == 0 {
+		sources = []ulid.ULID{orig.ULID}
+	}
+	meta.MinTime, meta.MaxTime = orig.MinTime, orig.MaxTime
+	meta.Compaction = tsdb.BlockMetaCompaction{
+		Level:   max(orig.Compaction.Level, 1),
+		Sources: sources,
+		Parents: []tsdb.BlockDesc{{ULID: orig.ULID, MinTime: orig.MinTime, MaxTime: orig.MaxTime}},
+	}
+	return meta
+}
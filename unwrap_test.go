@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// uploadTestBlock uploads meta.json and some data files of block to bkt under prefix
+func uploadTestBlock(t *testing.T, bkt objstore.Bucket, prefix string, id ulid.ULID) *Meta {
+	m := uploadTestMeta(t, bkt, prefix, id, nil)
+	for _, name := range []string{"index", "chunks/000001"} {
+		if err := bkt.Upload(context.Background(), prefix+id.String()+"/"+name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Meta{Meta: *m, Prefix: prefix}
+}
+
+// readUnwrapMark returns unwrap-mark.json of block dir in bkt, or nil when there is none
+func readUnwrapMark(t *testing.T, bkt objstore.Bucket, dir string) *UnwrapMark {
+	r, err := bkt.Get(context.Background(), dir+UnwrapMarkFilename)
+	if bkt.IsObjNotFoundErr(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var mark UnwrapMark
+	if err := json.NewDecoder(r).Decode(&mark); err != nil {
+		t.Fatal(err)
+	}
+	return &mark
+}
+
+// failingBucket fails uploads of objects having given prefix
+type failingBucket struct {
+	objstore.Bucket
+	prefix string
+}
+
+func (b *failingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if strings.HasPrefix(name, b.prefix) {
+		return errors.New("upload failed")
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func Test_unwrappedMeta(t *testing.T) {
+	orig := metadata.Meta{}
+	orig.ULID = ulid.MustNew(10, nil)
+	orig.MinTime, orig.MaxTime = 0, 8*3600*1000
+	orig.Compaction.Level = 3
+	orig.Compaction.Sources = []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil), ulid.MustNew(4, nil)}
+	orig.Compaction.Parents = []tsdb.BlockDesc{{ULID: ulid.MustNew(5, nil)}, {ULID: ulid.MustNew(6, nil)}}
+	mw, err := newMultiBlockWriter(t.TempDir(), nil, 2*orig.MaxTime, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := tsdb.BlockMeta{ULID: ulid.MustNew(20, nil), MinTime: 100, MaxTime: 200}
+	meta.Compaction.Level = 1
+	meta.Compaction.Sources = []ulid.ULID{meta.ULID}
+	res := mw.unwrappedMeta(meta)
+
+	if res.ULID != meta.ULID || res.MinTime != orig.MinTime || res.MaxTime != orig.MaxTime {
+		t.Errorf("unwrappedMeta()=%s [%d, %d), wants %s [%d, %d)", res.ULID, res.MinTime, res.MaxTime, meta.ULID, orig.MinTime, orig.MaxTime)
+	}
+	if res.Compaction.Level != 3 {
+		t.Errorf("unwrappedMeta() level=%d, wants 3", res.Compaction.Level)
+	}
+	if !reflect.DeepEqual(res.Compaction.Sources, orig.Compaction.Sources) {
+		t.Errorf("unwrappedMeta() sources=%v, wants %v", res.Compaction.Sources, orig.Compaction.Sources)
+	}
+	parents := []tsdb.BlockDesc{{ULID: orig.ULID, MinTime: orig.MinTime, MaxTime: orig.MaxTime}}
+	if !reflect.DeepEqual(res.Compaction.Parents, parents) {
+		t.Errorf("unwrappedMeta() parents=%v, wants %v", res.Compaction.Parents, parents)
+	}
+	// sources are copied, not shared with the original meta
+	res.Compaction.Sources[0] = meta.ULID
+	if orig.Compaction.Sources[0] == meta.ULID {
+		t.Errorf("unwrappedMeta() sources share memory with the original meta")
+	}
+}
+
+func Test_finishUnwrap(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+	dir, archived := "tenant/"+id.String()+"/", "archive/tenant/"+id.String()+"/"
+	cases := []struct {
+		onSuccess string
+		exists    []string
+		missing   []string
+		finished  string // dir of unwrap-mark.json having FinishTime
+	}{
+		{
+			onSuccess: onSuccessDelete,
+			missing:   []string{dir + metadata.MetaFilename, dir + "index", dir + UnwrapMarkFilename},
+		},
+		{
+			onSuccess: onSuccessMarkDeletion,
+			exists:    []string{dir + metadata.MetaFilename, dir + "index", dir + metadata.DeletionMarkFilename},
+			finished:  dir,
+		},
+		{
+			onSuccess: onSuccessKeep,
+			exists:    []string{dir + metadata.MetaFilename, dir + "index"},
+			missing:   []string{dir + metadata.DeletionMarkFilename},
+			finished:  dir,
+		},
+		{
+			onSuccess: onSuccessMove,
+			exists:    []string{archived + metadata.MetaFilename, archived + "index", archived + "chunks/000001"},
+			missing:   []string{dir + metadata.MetaFilename, dir + "index", dir + UnwrapMarkFilename},
+			finished:  archived,
+		},
+	}
+	for _, td := range cases {
+		ctx := context.Background()
+		bkt := objstore.NewInMemBucket()
+		m := uploadTestBlock(t, bkt, "tenant/", id)
+		mark := UnwrapMark{ID: id, Version: UnwrapMarkVersion1, Blocks: []ulid.ULID{ulid.MustNew(2, nil)}, UnwrapTime: 1}
+		if err := writeUnwrapMark(ctx, objstore.NewPrefixedBucket(bkt, "tenant/"), mark); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := finishUnwrap(ctx, bkt, m, mark, td.onSuccess, "archive/", log.NewNopLogger()); err != nil {
+			t.Fatalf("finishUnwrap(%s) error: %v", td.onSuccess, err)
+		}
+		for _, name := range td.exists {
+			if ok, _ := bkt.Exists(ctx, name); !ok {
+				t.Errorf("finishUnwrap(%s) wants %s to exist", td.onSuccess, name)
+			}
+		}
+		for _, name := range td.missing {
+			if ok, _ := bkt.Exists(ctx, name); ok {
+				t.Errorf("finishUnwrap(%s) wants %s to be deleted", td.onSuccess, name)
+			}
+		}
+		if td.finished != "" {
+			if res := readUnwrapMark(t, bkt, td.finished); res == nil || res.FinishTime == 0 {
+				t.Errorf("finishUnwrap(%s) mark in %s=%v, wants FinishTime to be set", td.onSuccess, td.finished, res)
+			}
+		}
+	}
+}
+
+func Test_finishUnwrapFailure(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+	cases := []struct {
+		onSuccess  string
+		failPrefix string
+	}{
+		{onSuccess: onSuccessMarkDeletion, failPrefix: "tenant/" + id.String() + "/" + metadata.DeletionMarkFilename},
+		{onSuccess: onSuccessMove, failPrefix: "archive/"},
+	}
+	for _, td := range cases {
+		ctx := context.Background()
+		bkt := objstore.NewInMemBucket()
+		m := uploadTestBlock(t, bkt, "tenant/", id)
+		mark := UnwrapMark{ID: id, Version: UnwrapMarkVersion1, Blocks: []ulid.ULID{ulid.MustNew(2, nil)}, UnwrapTime: 1}
+		if err := writeUnwrapMark(ctx, objstore.NewPrefixedBucket(bkt, "tenant/"), mark); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := finishUnwrap(ctx, &failingBucket{Bucket: bkt, prefix: td.failPrefix}, m, mark, td.onSuccess, "archive/", log.NewNopLogger()); err == nil {
+			t.Fatalf("finishUnwrap(%s) should fail", td.onSuccess)
+		}
+		// the next run should retry the policy
+		if res := readUnwrapMark(t, bkt, "tenant/"+id.String()+"/"); res == nil || res.FinishTime != 0 {
+			t.Errorf("finishUnwrap(%s) mark=%v, wants FinishTime not to be set", td.onSuccess, res)
+		}
+		if ok, _ := bkt.Exists(ctx, "tenant/"+id.String()+"/"+metadata.MetaFilename); !ok {
+			t.Errorf("finishUnwrap(%s) wants original block to exist", td.onSuccess)
+		}
+	}
+}
+
+func Test_resumeUnwrap(t *testing.T) {
+	id, id2, id3 := ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)
+	dir := "tenant/" + id.String() + "/"
+	cases := []struct {
+		name       string
+		noMark     bool
+		finished   bool
+		dryRun     bool
+		uploaded   []ulid.ULID // blocks existing in destination
+		done       bool
+		origExists bool
+		markExists bool
+		dstExists  []ulid.ULID
+	}{
+		{name: "no mark", noMark: true, uploaded: []ulid.ULID{id2}, origExists: true, dstExists: []ulid.ULID{id2}},
+		{name: "complete", uploaded: []ulid.ULID{id2, id3}, done: true, dstExists: []ulid.ULID{id2, id3}},
+		{name: "partial", uploaded: []ulid.ULID{id2}, origExists: true},
+		{name: "finished", finished: true, done: true, origExists: true, markExists: true},
+		{name: "dry-run partial", dryRun: true, uploaded: []ulid.ULID{id2}, origExists: true, markExists: true, dstExists: []ulid.ULID{id2}},
+		{name: "dry-run complete", dryRun: true, uploaded: []ulid.ULID{id2, id3}, origExists: true, markExists: true, dstExists: []ulid.ULID{id2, id3}},
+	}
+	for _, td := range cases {
+		ctx := context.Background()
+		bkt, dst := objstore.NewInMemBucket(), objstore.NewInMemBucket()
+		m := uploadTestBlock(t, bkt, "tenant/", id)
+		if !td.noMark {
+			mark := UnwrapMark{ID: id, Version: UnwrapMarkVersion1, Blocks: []ulid.ULID{id2, id3}, UnwrapTime: 1}
+			if td.finished {
+				mark.FinishTime = 2
+			}
+			if err := writeUnwrapMark(ctx, objstore.NewPrefixedBucket(bkt, "tenant/"), mark); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, u := range td.uploaded {
+			uploadTestBlock(t, dst, "", u)
+		}
+
+		done, err := resumeUnwrap(ctx, bkt, m, dst, td.dryRun, onSuccessDelete, "", newUnwrapMetrics(prometheus.NewRegistry()), log.NewNopLogger())
+		if err != nil {
+			t.Fatalf("resumeUnwrap(%s) error: %v", td.name, err)
+		}
+		if done != td.done {
+			t.Errorf("resumeUnwrap(%s)=%v, wants %v", td.name, done, td.done)
+		}
+		if ok, _ := bkt.Exists(ctx, dir+metadata.MetaFilename); ok != td.origExists {
+			t.Errorf("resumeUnwrap(%s) original block exists=%v, wants %v", td.name, ok, td.origExists)
+		}
+		if ok, _ := bkt.Exists(ctx, dir+UnwrapMarkFilename); ok != td.markExists {
+			t.Errorf("resumeUnwrap(%s) unwrap mark exists=%v, wants %v", td.name, ok, td.markExists)
+		}
+		for _, u := range []ulid.ULID{id2, id3} {
+			wants := false
+			for _, e := range td.dstExists {
+				wants = wants || e == u
+			}
+			if ok, _ := dst.Exists(ctx, u.String()+"/"+metadata.MetaFilename); ok != wants {
+				t.Errorf("resumeUnwrap(%s) destination block %s exists=%v, wants %v", td.name, u, ok, wants)
+			}
+		}
+	}
+}
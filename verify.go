@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/model"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxChunkIssues limits the number of reported broken chunks per block
+const maxChunkIssues = 10
+
+func verify(ctx context.Context, bkt objstore.Bucket, ids *[]string, recursive *bool, selector *[]string, maxTime, dataMinTime, dataMaxTime *model.TimeOrDurationValue, dir *string, markNoCompact bool, logger log.Logger) error {
+	sel, err := parseSelector(*selector)
+	if err != nil {
+		return errors.Wrap(err, "error parsing selector flag")
+	}
+	metas, err := getAllMetas(ctx, bkt, *recursive, maxTime, logger)
+	if err != nil {
+		return err
+	}
+	mint, maxt, _ := dataRange(dataMinTime, dataMaxTime)
+	selected := filterIDs(selectMetas(metas, sel, mint, maxt), *ids)
+	if missing := missingIDs(selected, *ids); len(missing) > 0 {
+		return errors.Errorf("requested blocks are not found or filtered out: %s", strings.Join(missing, ", "))
+	}
+
+	markedForNoCompact := noopCounter()
+	broken := 0
+	for _, m := range selected {
+		pb := objstore.NewPrefixedBucket(bkt, m.Prefix)
+		if err := downloadBlock(ctx, *dir, m.ULID.String(), pb, logger); err != nil {
+			return err
+		}
+		bdir := filepath.Join(*dir, m.ULID.String())
+		issues, err := verifyBlock(bdir, m, logger)
+		// do not keep the whole bucket in cache dir
+		if err := os.RemoveAll(bdir); err != nil {
+			return errors.Wrapf(err, "cleanup %s", bdir)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "verify block %s%s", m.Prefix, m.ULID)
+		}
+		if len(issues) == 0 {
+			level.Info(logger).Log("msg", "block is healthy", "id", m.Prefix+m.ULID.String())
+			continue
+		}
+
+		broken++
+		for _, issue := range issues {
+			fmt.Printf("%s%s %s\n", m.Prefix, m.ULID, issue)
+		}
+		if markNoCompact {
+			details := "thanos-kit verify: " + strings.Join(issues, "; ")
+			if err := block.MarkForNoCompact(ctx, logger, pb, m.ULID, metadata.ManualNoCompactReason, details, markedForNoCompact); err != nil {
+				return err
+			}
+		}
+	}
+	if broken > 0 {
+		return errors.Errorf("found %d broken blocks of %d", broken, len(selected))
+	}
+	return nil
+}
+
+// verifyBlock checks downloaded block in bdir and returns found issues
+func verifyBlock(bdir string, m *Meta, logger log.Logger) (issues []string, err error) {
+	// out of order labels and chunks, duplicated series, chunks outside of block time range
+	stats, err := block.GatherIndexHealthStats(logger, filepath.Join(bdir, block.IndexFilename), m.MinTime, m.MaxTime)
+	if err != nil {
+		// index is broken, no sense to go further
+		return []string{fmt.Sprintf("index: %v", err)}, nil
+	}
+	if err := stats.AnyErr(); err != nil {
+		issues = append(issues, fmt.Sprintf("index: %v", err))
+	}
+
+	// chunks references and meta.json stats
+	ir, err := index.NewFileReader(filepath.Join(bdir, block.IndexFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "open index")
+	}
+	defer ir.Close()
+	cr, err := chunks.NewDirReader(filepath.Join(bdir, block.ChunksDirname), nil)
+	if err != nil {
+		return append(issues, fmt.Sprintf("chunks: %v", err)), nil
+	}
+	defer cr.Close()
+
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "get all postings")
+	}
+	var (
+		builder                    labels.ScratchBuilder
+		chks                       []chunks.Meta
+		series, numChunks, samples uint64
+		brokenChunks               int
+	)
+	for p.Next() {
+		if err := ir.Series(p.At(), &builder, &chks); err != nil {
+			return nil, errors.Wrap(err, "read series")
+		}
+		series++
+		for _, c := range chks {
+			numChunks++
+			chk, err := cr.Chunk(c)
+			if err != nil {
+				brokenChunks++
+				if brokenChunks <= maxChunkIssues {
+					issues = append(issues, fmt.Sprintf("chunk %d of series %s: %v", c.Ref, builder.Labels(), err))
+				}
+				continue
+			}
+			samples += uint64(chk.NumSamples())
+		}
+	}
+	if p.Err() != nil {
+		return nil, errors.Wrap(p.Err(), "iterate postings")
+	}
+	if brokenChunks > maxChunkIssues {
+		issues = append(issues, fmt.Sprintf("%d more broken chunks", brokenChunks-maxChunkIssues))
+	}
+
+	if series != m.Stats.NumSeries {
+		issues = append(issues, fmt.Sprintf("meta.json numSeries=%d, actual %d", m.Stats.NumSeries, series))
+	}
+	if numChunks != m.Stats.NumChunks {
+		issues = append(issues, fmt.Sprintf("meta.json numChunks=%d, actual %d", m.Stats.NumChunks, numChunks))
+	}
+	if brokenChunks == 0 && samples != m.Stats.NumSamples {
+		issues = append(issues, fmt.Sprintf("meta.json numSamples=%d, actual %d", m.Stats.NumSamples, samples))
+	}
+	return issues, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/model"
+)
+
+// uploadTestMeta uploads meta.json of block with thanos labels to bkt under prefix
+func uploadTestMeta(t *testing.T, bkt objstore.Bucket, prefix string, id ulid.ULID, lbls map[string]string) *metadata.Meta {
+	m := &metadata.Meta{}
+	m.ULID = id
+	m.Version = metadata.TSDBVersion1
+	m.MinTime, m.MaxTime = 0, 100
+	m.Thanos.Version = metadata.ThanosVersion1
+	m.Thanos.Labels = lbls
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := bkt.Upload(context.Background(), prefix+id.String()+"/"+metadata.MetaFilename, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// testTime returns time flag value
+func testTime(t *testing.T, s string) *model.TimeOrDurationValue {
+	v := &model.TimeOrDurationValue{}
+	if err := v.Set(s); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func Test_verifyMissingIDs(t *testing.T) {
+	bkt := objstore.NewInMemBucket()
+	id1, id2 := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	uploadTestMeta(t, bkt, "", id1, map[string]string{"p": "a"})
+	uploadTestMeta(t, bkt, "", id2, map[string]string{"p": "b"})
+	missing := ulid.MustNew(3, nil)
+
+	cases := []struct {
+		ids      []string
+		selector []string
+		found    []string
+		missing  []string
+	}{
+		{ids: []string{id1.String(), missing.String()}, found: []string{id1.String()}, missing: []string{missing.String()}},
+		{ids: []string{id1.String(), id2.String()}, selector: []string{`p="a"`}, found: []string{id1.String()}, missing: []string{id2.String()}},
+	}
+	for _, td := range cases {
+		recursive, dir := false, t.TempDir()
+		err := verify(context.Background(), bkt, &td.ids, &recursive, &td.selector, testTime(t, "9999-12-31T23:59:59Z"), &model.TimeOrDurationValue{}, &model.TimeOrDurationValue{}, &dir, false, log.NewNopLogger())
+		if err == nil {
+			t.Fatalf("verify(%q, %q) should fail", td.ids, td.selector)
+		}
+		for _, id := range td.missing {
+			if !strings.Contains(err.Error(), id) {
+				t.Errorf("verify(%q, %q)=%v, wants %s to be reported", td.ids, td.selector, err, id)
+			}
+		}
+		for _, id := range td.found {
+			if strings.Contains(err.Error(), id) {
+				t.Errorf("verify(%q, %q)=%v, wants %s not to be reported", td.ids, td.selector, err, id)
+			}
+		}
+	}
+}
+
+// writeTestBlock writes block with a few series to dir, and returns its dir and meta
+func writeTestBlock(t *testing.T, dir string) (string, *Meta) {
+	w, err := tsdb.NewBlockWriter(log.NewNopLogger(), dir, tsdb.DefaultBlockDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := w.Appender(context.Background())
+	for i := 0; i < 3; i++ {
+		lbls := labels.FromStrings("__name__", "metric", "i", fmt.Sprint(i))
+		for ts := int64(0); ts < 10; ts++ {
+			if _, err := app.Append(0, lbls, ts*1000, float64(ts)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := w.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bdir := filepath.Join(dir, id.String())
+	b, err := tsdb.OpenBlock(nil, bdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	return bdir, &Meta{Meta: metadata.Meta{BlockMeta: b.Meta()}}
+}
+
+func Test_verifyBlock(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(t *testing.T, bdir string, m *Meta)
+		issues []string // substrings of expected issues, in order
+	}{
+		{name: "healthy", modify: func(*testing.T, string, *Meta) {}},
+		{
+			name: "wrong stats",
+			modify: func(_ *testing.T, _ string, m *Meta) {
+				m.Stats.NumSeries++
+				m.Stats.NumChunks++
+				m.Stats.NumSamples++
+			},
+			issues: []string{"meta.json numSeries=4, actual 3", "meta.json numChunks=4, actual 3", "meta.json numSamples=31, actual 30"},
+		},
+		{
+			name: "truncated chunks",
+			modify: func(t *testing.T, bdir string, _ *Meta) {
+				file := filepath.Join(bdir, block.ChunksDirname, "000001")
+				fi, err := os.Stat(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Truncate(file, fi.Size()-1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			issues: []string{`of series {__name__="metric", i="2"}`},
+		},
+	}
+	for _, td := range cases {
+		bdir, m := writeTestBlock(t, t.TempDir())
+		td.modify(t, bdir, m)
+		issues, err := verifyBlock(bdir, m, log.NewNopLogger())
+		if err != nil {
+			t.Fatalf("verifyBlock(%s) error = %v", td.name, err)
+		}
+		if len(issues) != len(td.issues) {
+			t.Fatalf("verifyBlock(%s)=%q, wants %q", td.name, issues, td.issues)
+		}
+		for i := range issues {
+			if !strings.Contains(issues[i], td.issues[i]) {
+				t.Errorf("verifyBlock(%s)=%q, wants %q", td.name, issues, td.issues)
+			}
+		}
+	}
+}